@@ -0,0 +1,388 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mukeshjc/mvcc-isolation/v2/mvcc"
+	"github.com/mukeshjc/mvcc-isolation/v2/utils"
+)
+
+// a schedule interleaves the calls of a few transactions one step at a time on an mvcc.Driver, in the order the steps are given. Every
+// transaction has a connection of its own and begins with its first step.
+type schedule struct {
+	database *mvcc.Database
+	level    mvcc.IsolationLevel
+	driver   *mvcc.Driver
+	txs      map[int]*scheduledTx
+}
+
+// only touched by the steps of the transaction until schedule.wait returns, the driver runs them one after the other.
+type scheduledTx struct {
+	err       error
+	committed bool
+}
+
+func newSchedule(database *mvcc.Database, level mvcc.IsolationLevel) *schedule {
+	return &schedule{database: database, level: level, driver: mvcc.NewDriver(database), txs: map[int]*scheduledTx{}}
+}
+
+// step runs op in transaction i, unless an earlier step of it failed: then the transaction is over and the rest of its steps are skipped.
+func (s *schedule) step(i int, op func(c *mvcc.Connection) error) {
+	st := s.tx(i)
+	s.driver.Step(i-1, func(c *mvcc.Connection) (string, error) {
+		if st.err != nil {
+			return "", nil
+		}
+		// a failure the database didn't roll back for rolls back here, it's over either way. If it did, the rollback fails, which is fine.
+		if st.err = op(c); st.err != nil {
+			c.ExecCommand("rollback", nil)
+		}
+		return "", nil
+	})
+}
+
+// transaction i, begun on its first use. Beginning is a step of its own: the driver only tells a waiting step from a running one once it
+// knows the transaction.
+func (s *schedule) tx(i int) *scheduledTx {
+	st, ok := s.txs[i]
+	if !ok {
+		st = &scheduledTx{}
+		s.txs[i] = st
+		s.driver.Step(i-1, func(c *mvcc.Connection) (string, error) {
+			_, err := c.Begin(s.level)
+			utils.AssertEq(err, nil, "begin")
+			return "", nil
+		})
+	}
+	return st
+}
+
+func (s *schedule) exec(i int, command ...string) {
+	s.step(i, func(c *mvcc.Connection) error { return exec(c, command...) })
+}
+
+func exec(c *mvcc.Connection, command ...string) error {
+	_, err := c.ExecCommand(command[0], command[1:])
+	return err
+}
+
+func (s *schedule) get(i int, key string, value *string) {
+	s.step(i, func(c *mvcc.Connection) error {
+		v, err := c.ExecCommand("get", []string{key})
+		if errors.Is(err, mvcc.ErrNotFound) {
+			err = nil
+		}
+		*value = v
+		return err
+	})
+}
+
+func (s *schedule) set(i int, key string, value string) {
+	s.exec(i, "set", key, value)
+}
+
+func (s *schedule) commit(i int) {
+	st := s.tx(i)
+	s.step(i, func(c *mvcc.Connection) error {
+		err := exec(c, "commit")
+		st.committed = err == nil
+		return err
+	})
+}
+
+func (s *schedule) rollback(i int) {
+	s.exec(i, "rollback")
+}
+
+// wait until every step ran. Failures are only ever serialization failures.
+func (s *schedule) wait() {
+	s.driver.Wait()
+	for _, st := range s.txs {
+		if st.err != nil {
+			utils.Assert(errors.Is(st.err, mvcc.ErrSerialization), fmt.Sprintf("only serialization failures, got %v", st.err))
+		}
+	}
+}
+
+func (s *schedule) committed(i int) bool {
+	return s.txs[i].committed
+}
+
+// the latest committed value of key once the schedule is over.
+func (s *schedule) final(key string) string {
+	level := mvcc.ReadCommittedIsolation
+	tx, _ := s.database.Begin(mvcc.TxOptions{Isolation: &level})
+	defer tx.Commit()
+	value, _ := tx.Get(key)
+	return value
+}
+
+// every anomaly is a schedule that exhibits it (if the level doesn't prevent it), with the phenomenon it is an example of in Adya's
+// "Weak Consistency: A Generalized Theory and Optimistic Implementations for Distributed Transactions" (and the ANSI name, if any).
+// https://jepsen.io/consistency has the same definitions.
+//
+// the anomaly happened when it shows up in what committed transactions read or left behind. A transaction rolled back by the database
+// doesn't count: preventing anomalies is exactly what those rollbacks are for.
+var anomalies = []struct {
+	name       string
+	phenomenon string
+	// the isolation levels that allow the anomaly, all others must prevent it.
+	allowedBy []mvcc.IsolationLevel
+	// committed before the schedule runs. Keys not in it are 0.
+	setup map[string]string
+	run   func(s *schedule) bool
+}{
+	{
+		// T1 and T2 overwrite each other's uncommitted writes of x and y in opposite orders: the result is half one, half the other.
+		// Adya forbids it at every level, even read uncommitted. Here writers only wait for each other with WithBlockingWrites, without it
+		// levels up to repeatable read, which never fail on write-write conflicts, let it through.
+		name:       "dirty write",
+		phenomenon: "G0 (P0)",
+		allowedBy:  []mvcc.IsolationLevel{mvcc.ReadUncommittedIsolation, mvcc.ReadCommittedIsolation, mvcc.RepeatableReadIsolation},
+		run: func(s *schedule) bool {
+			s.set(1, "x", "1")
+			s.set(2, "x", "2")
+			s.set(2, "y", "2")
+			s.set(1, "y", "1")
+			s.commit(1)
+			s.commit(2)
+			s.wait()
+			return s.committed(1) && s.committed(2) && s.final("x") != s.final("y")
+		},
+	},
+	{
+		// T2 reads what T1 wrote, and T1 rolls back.
+		name:       "dirty read",
+		phenomenon: "G1a (P1)",
+		allowedBy:  []mvcc.IsolationLevel{mvcc.ReadUncommittedIsolation},
+		run: func(s *schedule) bool {
+			var read string
+			s.set(1, "x", "1")
+			s.get(2, "x", &read)
+			s.rollback(1)
+			s.commit(2)
+			s.wait()
+			return s.committed(2) && read == "1"
+		},
+	},
+	{
+		// T1 reads x twice, T2 changes it in between.
+		name:       "fuzzy read",
+		phenomenon: "G2-item (P2)",
+		allowedBy:  []mvcc.IsolationLevel{mvcc.ReadUncommittedIsolation, mvcc.ReadCommittedIsolation},
+		run: func(s *schedule) bool {
+			var first, second string
+			s.get(1, "x", &first)
+			s.set(2, "x", "1")
+			s.commit(2)
+			s.get(1, "x", &second)
+			s.commit(1)
+			s.wait()
+			return s.committed(1) && first != second
+		},
+	},
+	{
+		// T1 and T2 both increment x from the value they read, one increment is lost. Adya's repeatable read (PL-2.99) forbids it, it is
+		// G2-item. Here repeatable read is only a snapshot without write-write checks, which allows it. Snapshot isolation is what Postgres
+		// calls repeatable read.
+		name:       "lost update",
+		phenomenon: "G2-item (P4)",
+		allowedBy:  []mvcc.IsolationLevel{mvcc.ReadUncommittedIsolation, mvcc.ReadCommittedIsolation, mvcc.RepeatableReadIsolation},
+		run: func(s *schedule) bool {
+			var read1, read2 string
+			s.get(1, "x", &read1)
+			s.get(2, "x", &read2)
+			s.step(1, func(c *mvcc.Connection) error { return exec(c, "set", "x", increment(read1)) })
+			s.step(2, func(c *mvcc.Connection) error { return exec(c, "set", "x", increment(read2)) })
+			s.commit(1)
+			s.commit(2)
+			s.wait()
+			return s.committed(1) && s.committed(2) && s.final("x") != "2"
+		},
+	},
+	{
+		// x and y always add up to 100. T2 moves 25 from x to y while T1 reads x before and y after.
+		name:       "read skew",
+		phenomenon: "G-single (A5A)",
+		allowedBy:  []mvcc.IsolationLevel{mvcc.ReadUncommittedIsolation, mvcc.ReadCommittedIsolation},
+		setup:      map[string]string{"x": "50", "y": "50"},
+		run: func(s *schedule) bool {
+			var x, y string
+			s.get(1, "x", &x)
+			s.set(2, "x", "25")
+			s.set(2, "y", "75")
+			s.commit(2)
+			s.get(1, "y", &y)
+			s.commit(1)
+			s.wait()
+			return s.committed(1) && atoi(x)+atoi(y) != 100
+		},
+	},
+	{
+		// at least one of x and y must stay on call. Both see the other one on call, and both go off call.
+		name:       "write skew",
+		phenomenon: "G2-item (A5B)",
+		allowedBy: []mvcc.IsolationLevel{
+			mvcc.ReadUncommittedIsolation, mvcc.ReadCommittedIsolation, mvcc.RepeatableReadIsolation, mvcc.SnapshotIsolation,
+		},
+		setup: map[string]string{"x": "1", "y": "1"},
+		run: func(s *schedule) bool {
+			var x1, y1, x2, y2 string
+			s.get(1, "x", &x1)
+			s.get(1, "y", &y1)
+			s.get(2, "x", &x2)
+			s.get(2, "y", &y2)
+			s.step(1, func(c *mvcc.Connection) error {
+				if atoi(x1)+atoi(y1) < 2 {
+					return nil
+				}
+				return exec(c, "set", "x", "0")
+			})
+			s.step(2, func(c *mvcc.Connection) error {
+				if atoi(x2)+atoi(y2) < 2 {
+					return nil
+				}
+				return exec(c, "set", "y", "0")
+			})
+			s.commit(1)
+			s.commit(2)
+			s.wait()
+			return s.committed(1) && s.committed(2) && s.final("x") == "0" && s.final("y") == "0"
+		},
+	},
+	{
+		// write skew over a predicate: both check that a room has no booking by scanning for it, then both book it.
+		// neither reads a key the other writes, the conflict is a key inside a range the other scanned.
+		name:       "phantom",
+		phenomenon: "G2 (P3)",
+		allowedBy: []mvcc.IsolationLevel{
+			mvcc.ReadUncommittedIsolation, mvcc.ReadCommittedIsolation, mvcc.RepeatableReadIsolation, mvcc.SnapshotIsolation,
+		},
+		run: func(s *schedule) bool {
+			who := []string{1: "alice", 2: "bob"}
+			free := make([]bool, len(who))
+			for i := 1; i < len(who); i++ {
+				s.step(i, func(c *mvcc.Connection) error {
+					kvs, err := c.ExecCommand("prefix", []string{"room/"})
+					free[i] = kvs == ""
+					return err
+				})
+			}
+			for i := 1; i < len(who); i++ {
+				s.step(i, func(c *mvcc.Connection) error {
+					if !free[i] {
+						return nil
+					}
+					return exec(c, "set", "room/"+who[i], "booked")
+				})
+			}
+			s.commit(1)
+			s.commit(2)
+			s.wait()
+			return s.committed(1) && s.committed(2) && s.final("room/alice") != "" && s.final("room/bob") != ""
+		},
+	},
+	{
+		// Fekete, O'Neil and O'Neil's "A Read-Only Transaction Anomaly Under Snapshot Isolation": x is checking, y savings. T2 withdraws 10
+		// from checking, charging a penalty of 1 if that overdraws the total. T1 deposits 20 into savings. The read-only T3 sees the deposit
+		// but not the withdrawal, which only makes sense if T1 ran before T2. But T2 didn't see the deposit and charged the penalty.
+		name:       "read-only anomaly",
+		phenomenon: "G2 (read-only)",
+		allowedBy: []mvcc.IsolationLevel{
+			mvcc.ReadUncommittedIsolation, mvcc.ReadCommittedIsolation, mvcc.RepeatableReadIsolation, mvcc.SnapshotIsolation,
+		},
+		run: func(s *schedule) bool {
+			var x2, y2, y1, x3, y3 string
+			s.get(2, "x", &x2)
+			s.get(2, "y", &y2)
+			s.get(1, "y", &y1)
+			s.step(1, func(c *mvcc.Connection) error { return exec(c, "set", "y", strconv.Itoa(atoi(y1)+20)) })
+			s.commit(1)
+			s.get(3, "x", &x3)
+			s.get(3, "y", &y3)
+			s.commit(3)
+			s.step(2, func(c *mvcc.Connection) error {
+				withdrawn := atoi(x2) - 10
+				if atoi(x2)+atoi(y2) < 10 {
+					withdrawn--
+				}
+				return exec(c, "set", "x", strconv.Itoa(withdrawn))
+			})
+			s.commit(2)
+			s.wait()
+			return s.committed(1) && s.committed(2) && s.committed(3) && x3 == "0" && y3 == "20" && s.final("x") == "-11"
+		},
+	},
+}
+
+func increment(value string) string {
+	return strconv.Itoa(atoi(value) + 1)
+}
+
+// missing keys read as 0.
+func atoi(value string) int {
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	utils.AssertEq(err, nil, "atoi")
+	return n
+}
+
+// every anomaly against every isolation level. Run with -v for the matrix of which level allows which anomaly.
+func TestAnomalies(t *testing.T) {
+	t.Parallel()
+
+	var levels []mvcc.IsolationLevel
+	for level := mvcc.ReadUncommittedIsolation; level <= mvcc.TwoPhaseLockingSerializableIsolation; level++ {
+		levels = append(levels, level)
+	}
+
+	matrix := make([][]bool, len(anomalies))
+	for i, anomaly := range anomalies {
+		matrix[i] = make([]bool, len(levels))
+		for j, level := range levels {
+			database := mvcc.NewDatabase(level)
+			for _, key := range []string{"x", "y"} {
+				value, ok := anomaly.setup[key]
+				if !ok {
+					value = "0"
+				}
+				update(database, key, value)
+			}
+
+			matrix[i][j] = anomaly.run(newSchedule(database, level))
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-20s %-16s", "", "")
+	for _, level := range levels {
+		fmt.Fprintf(&b, " %-21s", level)
+	}
+	for i, anomaly := range anomalies {
+		fmt.Fprintf(&b, "\n%-20s %-16s", anomaly.name, anomaly.phenomenon)
+		for j := range levels {
+			cell := "prevented"
+			if matrix[i][j] {
+				cell = "allowed"
+			}
+			fmt.Fprintf(&b, " %-21s", cell)
+		}
+	}
+	t.Log("\n" + b.String())
+
+	for i, anomaly := range anomalies {
+		for j, level := range levels {
+			allowed := false
+			for _, l := range anomaly.allowedBy {
+				allowed = allowed || l == level
+			}
+			utils.AssertEq(matrix[i][j], allowed, fmt.Sprintf("%v allows %v", level, anomaly.name))
+		}
+	}
+}
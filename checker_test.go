@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mukeshjc/mvcc-isolation/v2/mvcc"
+	"github.com/mukeshjc/mvcc-isolation/v2/utils"
+)
+
+// appends element to the list at key, the way the checker expects: read the list, write it back one element longer.
+func appendElement(c *mvcc.Connection, key string, element string) error {
+	list, err := c.ExecCommand("get", []string{key})
+	if errors.Is(err, mvcc.ErrNotFound) {
+		list, err = "", nil
+	}
+	if err != nil {
+		return err
+	}
+	if list != "" {
+		list += ","
+	}
+	_, err = c.ExecCommand("set", []string{key, list + element})
+	return err
+}
+
+func assertAnomalies(anomalies []mvcc.Anomaly, kinds []mvcc.AnomalyKind, msg string) {
+	found := make([]mvcc.AnomalyKind, len(anomalies))
+	for i, a := range anomalies {
+		found[i] = a.Kind
+	}
+	utils.AssertEq(fmt.Sprint(found), fmt.Sprint(kinds), fmt.Sprintf("%s: %v", msg, anomalies))
+}
+
+// random list-append transactions on a few hot keys, from a few connections at once. Whatever the level lets through, the history never
+// shows an anomaly it proscribes.
+func TestCheckerRandomWorkloads(t *testing.T) {
+	t.Parallel()
+
+	for level := mvcc.ReadUncommittedIsolation; level <= mvcc.TwoPhaseLockingSerializableIsolation; level++ {
+		t.Run(level.String(), func(t *testing.T) {
+			t.Parallel()
+
+			recorder := mvcc.NewRecorder()
+			database, err := mvcc.OpenDatabase(level, mvcc.WithRecorder(recorder))
+			utils.AssertEq(err, nil, "open database")
+			defer database.Close()
+
+			const processes = 6
+			const txs = 40
+			keys := []string{"x", "y", "z"}
+
+			var elements atomic.Int64
+			var wg sync.WaitGroup
+			for p := 0; p < processes; p++ {
+				wg.Add(1)
+				go func(seed int64) {
+					defer wg.Done()
+
+					r := rand.New(rand.NewSource(seed))
+					c := database.NewConnection()
+					for i := 0; i < txs; i++ {
+						c.MustExecCommand("begin", nil)
+
+						var err error
+						for j := 0; j < 1+r.Intn(3) && err == nil; j++ {
+							key := keys[r.Intn(len(keys))]
+							if r.Intn(3) == 0 {
+								_, err = c.ExecCommand("get", []string{key})
+								if errors.Is(err, mvcc.ErrNotFound) {
+									err = nil
+								}
+							} else {
+								err = appendElement(c, key, strconv.FormatInt(elements.Add(1), 10))
+							}
+						}
+
+						// a failure usually rolled the transaction back already, then there's nothing left to roll back.
+						if err == nil && r.Intn(5) > 0 {
+							c.ExecCommand("commit", nil)
+						} else {
+							c.ExecCommand("rollback", nil)
+						}
+					}
+				}(int64(p))
+			}
+			wg.Wait()
+
+			events := recorder.Events()
+			utils.Assert(len(events) > 0, "history recorded")
+			anomalies := mvcc.CheckHistory(events, level)
+			utils.AssertEq(len(anomalies), 0, fmt.Sprintf("%v: %v\n%s", level, anomalies, mvcc.FormatEvents(events)))
+			allowed := map[mvcc.AnomalyKind]int{}
+			for _, a := range mvcc.FindAnomalies(events) {
+				allowed[a.Kind]++
+			}
+			t.Logf("%d events, anomalies allowed at %v: %v", len(events), level, allowed)
+		})
+	}
+}
+
+// histories with a known anomaly, checked against a level that forbids it and one that doesn't.
+func TestCheckerFindsAnomalies(t *testing.T) {
+	t.Parallel()
+
+	t.Run("write skew", func(t *testing.T) {
+		t.Parallel()
+
+		recorder := mvcc.NewRecorder()
+		database, _ := mvcc.OpenDatabase(mvcc.SnapshotIsolation, mvcc.WithRecorder(recorder))
+		c1, c2 := database.NewConnection(), database.NewConnection()
+		c1.MustExecCommand("begin", nil)
+		c2.MustExecCommand("begin", nil)
+		c1.ExecCommand("get", []string{"y"})
+		c2.ExecCommand("get", []string{"x"})
+		utils.AssertEq(appendElement(c1, "x", "1"), nil, "append x")
+		utils.AssertEq(appendElement(c2, "y", "2"), nil, "append y")
+		c1.MustExecCommand("commit", nil)
+		c2.MustExecCommand("commit", nil)
+
+		events := recorder.Events()
+		assertAnomalies(mvcc.CheckHistory(events, mvcc.SnapshotIsolation), nil, "snapshot isolation allows write skew")
+		anomalies := mvcc.CheckHistory(events, mvcc.SerializableIsolation)
+		assertAnomalies(anomalies, []mvcc.AnomalyKind{mvcc.AnomalyG2}, "serializable forbids write skew")
+		utils.AssertEq(anomalies[0].Explanation, "1 -rw(y)-> 2 -rw(x)-> 1", "write skew cycle")
+	})
+
+	t.Run("lost update", func(t *testing.T) {
+		t.Parallel()
+
+		recorder := mvcc.NewRecorder()
+		database, _ := mvcc.OpenDatabase(mvcc.RepeatableReadIsolation, mvcc.WithRecorder(recorder))
+		c1, c2 := database.NewConnection(), database.NewConnection()
+		c1.MustExecCommand("begin", nil)
+		c2.MustExecCommand("begin", nil)
+		utils.AssertEq(appendElement(c1, "x", "1"), nil, "append x")
+		utils.AssertEq(appendElement(c2, "x", "2"), nil, "append x")
+		c1.MustExecCommand("commit", nil)
+		c2.MustExecCommand("commit", nil)
+
+		events := recorder.Events()
+		assertAnomalies(mvcc.CheckHistory(events, mvcc.RepeatableReadIsolation), nil, "repeatable read allows lost updates")
+		assertAnomalies(mvcc.CheckHistory(events, mvcc.SnapshotIsolation), []mvcc.AnomalyKind{mvcc.AnomalyLostUpdate}, "snapshot isolation forbids lost updates")
+	})
+
+	t.Run("aborted read", func(t *testing.T) {
+		t.Parallel()
+
+		recorder := mvcc.NewRecorder()
+		database, _ := mvcc.OpenDatabase(mvcc.ReadUncommittedIsolation, mvcc.WithRecorder(recorder))
+		c1, c2 := database.NewConnection(), database.NewConnection()
+		c1.MustExecCommand("begin", nil)
+		c2.MustExecCommand("begin", nil)
+		utils.AssertEq(appendElement(c1, "x", "1"), nil, "append x")
+		utils.AssertEq(appendElement(c2, "x", "2"), nil, "append x")
+		c1.MustExecCommand("rollback", nil)
+		c2.MustExecCommand("commit", nil)
+
+		events := recorder.Events()
+		assertAnomalies(mvcc.CheckHistory(events, mvcc.ReadUncommittedIsolation), nil, "read uncommitted allows aborted reads")
+		assertAnomalies(mvcc.CheckHistory(events, mvcc.ReadCommittedIsolation), []mvcc.AnomalyKind{mvcc.AnomalyG1a}, "read committed forbids aborted reads")
+	})
+
+	t.Run("read skew", func(t *testing.T) {
+		t.Parallel()
+
+		recorder := mvcc.NewRecorder()
+		database, _ := mvcc.OpenDatabase(mvcc.ReadCommittedIsolation, mvcc.WithRecorder(recorder))
+		c1, c2 := database.NewConnection(), database.NewConnection()
+		c1.MustExecCommand("begin", nil)
+		c2.MustExecCommand("begin", nil)
+		c1.ExecCommand("get", []string{"x"})
+		utils.AssertEq(appendElement(c2, "x", "1"), nil, "append x")
+		utils.AssertEq(appendElement(c2, "y", "2"), nil, "append y")
+		c2.MustExecCommand("commit", nil)
+		c1.MustExecCommand("get", []string{"y"})
+		c1.MustExecCommand("commit", nil)
+
+		events := recorder.Events()
+		assertAnomalies(mvcc.CheckHistory(events, mvcc.ReadCommittedIsolation), nil, "read committed allows read skew")
+		anomalies := mvcc.CheckHistory(events, mvcc.RepeatableReadIsolation)
+		assertAnomalies(anomalies, []mvcc.AnomalyKind{mvcc.AnomalyGSingle}, "repeatable read forbids read skew")
+		utils.AssertEq(anomalies[0].Explanation, "1 -rw(x)-> 2 -wr(y)-> 1", "read skew cycle")
+	})
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"math/rand"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mukeshjc/mvcc-isolation/v2/mvcc"
+	"github.com/mukeshjc/mvcc-isolation/v2/utils"
+)
+
+// differential testing: random transactions run interleaved against the database, and whatever committed has to be explainable by running the
+// committed transactions one after the other on a plain map, in some order. The interleaving is picked by the seed as well, so a failing seed
+// replays exactly:
+//
+//	go test -run TestDifferential -differential.seed 1234 -v
+//
+// and before a failure is reported, it is shrunk to as few transactions and commands as still fail.
+//
+// the same cases also run for real, every transaction from its own goroutine on its own connection. Those runs don't replay, but they let the
+// scheduler find the interleavings a schedule can't express, like two commits racing each other.
+
+var differentialSeed = flag.Int64("differential.seed", 0, "replay a single seed of TestDifferential")
+
+type diffOp struct {
+	command string
+	key     string
+	value   string
+}
+
+func (op diffOp) String() string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s %s", op.command, op.key, op.value))
+}
+
+type diffCase struct {
+	level mvcc.IsolationLevel
+	txs   [][]diffOp
+	// which transaction takes the next step: its begin, one of its commands, or its commit.
+	schedule []int
+}
+
+// what the database did with a case.
+type diffResult struct {
+	committed []bool
+	// what the commands of every transaction returned: the value, "<nil>" for a key that doesn't exist, or "ok" for a set or delete.
+	observed [][]string
+	final    map[string]string
+}
+
+var diffKeys = []string{"a", "b", "c"}
+
+func generateCase(seed int64, level mvcc.IsolationLevel) diffCase {
+	r := rand.New(rand.NewSource(seed))
+	c := diffCase{level: level}
+
+	steps := map[int]int{}
+	for i := 0; i < 2+r.Intn(4); i++ {
+		var ops []diffOp
+		for j := 0; j < 1+r.Intn(4); j++ {
+			op := diffOp{command: []string{"get", "get", "set", "delete"}[r.Intn(4)], key: diffKeys[r.Intn(len(diffKeys))]}
+			if op.command == "set" {
+				// unique values tell which transaction wrote what.
+				op.value = fmt.Sprintf("%d.%d", i+1, j+1)
+			}
+			ops = append(ops, op)
+		}
+		c.txs = append(c.txs, ops)
+		steps[i] = len(ops) + 2
+	}
+
+	for len(steps) > 0 {
+		left := slices.Sorted(maps.Keys(steps))
+		i := left[r.Intn(len(left))]
+		c.schedule = append(c.schedule, i)
+		if steps[i]--; steps[i] == 0 {
+			delete(steps, i)
+		}
+	}
+	return c
+}
+
+func (c diffCase) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v", c.level)
+	for i, ops := range c.txs {
+		fmt.Fprintf(&b, "\nT%d: %v", i+1, ops)
+	}
+	fmt.Fprintf(&b, "\nschedule: %v", c.schedule)
+	return b.String()
+}
+
+// run steps through the schedule on a fresh database with an mvcc.Driver, so the same case always runs the same way, waits for locks
+// included. A transaction that fails a command is over, the rest of its steps are skipped.
+func (c diffCase) run() diffResult {
+	database := mvcc.NewDatabase(c.level)
+	defer database.Close()
+	res := diffResult{committed: make([]bool, len(c.txs)), observed: make([][]string, len(c.txs))}
+
+	driver := mvcc.NewDriver(database)
+	next := make([]int, len(c.txs))
+	// like res, failed[i] is only touched by the steps of transaction i, which the driver runs one after the other.
+	failed := make([]bool, len(c.txs))
+	for _, i := range c.schedule {
+		step := next[i]
+		next[i]++
+		driver.Step(i, func(conn *mvcc.Connection) (string, error) {
+			if failed[i] {
+				return "", nil
+			}
+
+			switch {
+			case step == 0:
+				conn.MustExecCommand("begin", nil)
+			case step == len(c.txs[i])+1:
+				_, err := conn.ExecCommand("commit", nil)
+				res.committed[i] = err == nil
+			default:
+				value, err := execDiffOp(conn, c.txs[i][step-1])
+				if err != nil {
+					failed[i] = true
+					conn.ExecCommand("rollback", nil)
+					break
+				}
+				res.observed[i] = append(res.observed[i], value)
+			}
+			return "", nil
+		})
+	}
+	driver.Wait()
+
+	res.final = diffFinal(database)
+	return res
+}
+
+// runConcurrently runs every transaction of the case from its own goroutine, all of them at once. The schedule is ignored, how the
+// transactions interleave is up to the scheduler and the locks they wait for.
+func (c diffCase) runConcurrently() diffResult {
+	database := mvcc.NewDatabase(c.level)
+	defer database.Close()
+	res := diffResult{committed: make([]bool, len(c.txs)), observed: make([][]string, len(c.txs))}
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, ops := range c.txs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn := database.NewConnection()
+			<-start
+			conn.MustExecCommand("begin", nil)
+			for _, op := range ops {
+				// commands take so little time that without a chance to switch, every transaction would run alone.
+				runtime.Gosched()
+				value, err := execDiffOp(conn, op)
+				if err != nil {
+					conn.ExecCommand("rollback", nil)
+					return
+				}
+				res.observed[i] = append(res.observed[i], value)
+			}
+			runtime.Gosched()
+			_, err := conn.ExecCommand("commit", nil)
+			res.committed[i] = err == nil
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	res.final = diffFinal(database)
+	return res
+}
+
+// runs a command of a case, returning what the reference model returns for it. An error other than a missing key ends the transaction.
+func execDiffOp(conn *mvcc.Connection, op diffOp) (string, error) {
+	args := []string{op.key}
+	if op.command == "set" {
+		args = append(args, op.value)
+	}
+	value, err := conn.ExecCommand(op.command, args)
+	switch {
+	case errors.Is(err, mvcc.ErrNotFound):
+		return "<nil>", nil
+	case err != nil:
+		return "", err
+	case op.command != "get":
+		return "ok", nil
+	}
+	return value, nil
+}
+
+// the committed value of every key once a case ran.
+func diffFinal(database *mvcc.Database) map[string]string {
+	final := map[string]string{}
+	conn := database.NewConnection()
+	conn.MustExecCommand("begin", nil)
+	for _, key := range diffKeys {
+		if value, err := conn.ExecCommand("get", []string{key}); err == nil {
+			final[key] = value
+		}
+	}
+	conn.MustExecCommand("commit", nil)
+	return final
+}
+
+// the reference model: runs the commands of a transaction on a map, and reports whether they return what the database returned.
+func (c diffCase) replay(state map[string]string, i int, observed []string) bool {
+	for j, op := range c.txs[i] {
+		var value string
+		switch op.command {
+		case "get":
+			var ok bool
+			if value, ok = state[op.key]; !ok {
+				value = "<nil>"
+			}
+		case "set":
+			state[op.key] = op.value
+			value = "ok"
+		case "delete":
+			value = "ok"
+			if _, ok := state[op.key]; !ok {
+				value = "<nil>"
+			}
+			delete(state, op.key)
+		}
+		if value != observed[j] {
+			return false
+		}
+	}
+	return true
+}
+
+// check runs the case by its schedule and returns an error unless the result is serializable, see verify.
+func (c diffCase) check() error {
+	return c.verify(c.run())
+}
+
+// verify returns an error unless the committed transactions of res match some serial order of them on the reference model. Only orders in
+// which every transaction reads what it read in the database are followed, so the search stays small.
+func (c diffCase) verify(res diffResult) error {
+	var committed []int
+	for i, ok := range res.committed {
+		if ok {
+			committed = append(committed, i)
+		}
+	}
+
+	var search func(state map[string]string, order []int) []int
+	search = func(state map[string]string, order []int) []int {
+		if len(order) == len(committed) {
+			if maps.Equal(state, res.final) {
+				return order
+			}
+			return nil
+		}
+		for _, i := range committed {
+			if slices.Contains(order, i) {
+				continue
+			}
+			next := maps.Clone(state)
+			if !c.replay(next, i, res.observed[i]) {
+				continue
+			}
+			if found := search(next, append(slices.Clone(order), i)); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+	if search(map[string]string{}, nil) != nil {
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "no serial order of the committed transactions matches")
+	for i := range c.txs {
+		fmt.Fprintf(&b, "\nT%d committed=%v observed=%q", i+1, res.committed[i], res.observed[i])
+	}
+	fmt.Fprintf(&b, "\nfinal %v", res.final)
+	return errors.New(b.String())
+}
+
+// the smaller cases shrink tries: without one of the transactions, or without one of the commands of one.
+func (c diffCase) shrinks() []diffCase {
+	var smaller []diffCase
+	for i := range c.txs {
+		s := diffCase{level: c.level, txs: slices.Delete(slices.Clone(c.txs), i, i+1)}
+		for _, j := range c.schedule {
+			if j < i {
+				s.schedule = append(s.schedule, j)
+			} else if j > i {
+				s.schedule = append(s.schedule, j-1)
+			}
+		}
+		smaller = append(smaller, s)
+	}
+
+	for i, ops := range c.txs {
+		if len(ops) == 1 {
+			continue
+		}
+		for j := range ops {
+			s := diffCase{level: c.level, txs: slices.Clone(c.txs)}
+			s.txs[i] = slices.Delete(slices.Clone(ops), j, j+1)
+			// the transaction takes one step less, drop its last one.
+			last := len(c.schedule) - 1
+			for c.schedule[last] != i {
+				last--
+			}
+			s.schedule = slices.Delete(slices.Clone(c.schedule), last, last+1)
+			smaller = append(smaller, s)
+		}
+	}
+	return smaller
+}
+
+// shrink returns the smallest case it finds that still fails, trying the shrinks of the failing case until none of them fails.
+func shrink(c diffCase) (diffCase, error) {
+	err := c.check()
+	utils.Assert(err != nil, "shrinking a failing case")
+	for shrunk := true; shrunk; {
+		shrunk = false
+		for _, s := range c.shrinks() {
+			if sErr := s.check(); sErr != nil {
+				c, err, shrunk = s, sErr, true
+				break
+			}
+		}
+	}
+	return c, err
+}
+
+func TestDifferential(t *testing.T) {
+	t.Parallel()
+
+	seeds := []int64{}
+	if *differentialSeed != 0 {
+		seeds = append(seeds, *differentialSeed)
+	} else {
+		for seed := int64(1); seed <= 2000; seed++ {
+			seeds = append(seeds, seed)
+		}
+	}
+
+	// serializable snapshot isolation and two-phase locking as well, they are cheap.
+	levels := []mvcc.IsolationLevel{mvcc.SerializableIsolation, mvcc.SerializableSnapshotIsolation, mvcc.TwoPhaseLockingSerializableIsolation}
+	for _, level := range levels {
+		for _, seed := range seeds {
+			c := generateCase(seed, level)
+			if *differentialSeed != 0 {
+				t.Logf("%v\n%+v", c, c.run())
+			}
+			if err := c.check(); err != nil {
+				shrunk, err := shrink(c)
+				t.Fatalf("%v: seed %d fails, replay with -differential.seed %d. Shrunk to:\n%v\n%v", level, seed, seed, shrunk, err)
+			}
+		}
+	}
+}
+
+// the cases of TestDifferential once more, from a goroutine per transaction. A failure can't be replayed, the case it happened with is
+// reported as is.
+func TestDifferentialConcurrent(t *testing.T) {
+	t.Parallel()
+
+	levels := []mvcc.IsolationLevel{mvcc.SerializableIsolation, mvcc.SerializableSnapshotIsolation, mvcc.TwoPhaseLockingSerializableIsolation}
+	for _, level := range levels {
+		t.Run(level.String(), func(t *testing.T) {
+			t.Parallel()
+
+			for seed := int64(1); seed <= 2000; seed++ {
+				c := generateCase(seed, level)
+				res := c.runConcurrently()
+				if err := c.verify(res); err != nil {
+					t.Fatalf("%v: seed %d fails when run concurrently:\n%v\n%v", level, seed, c, err)
+				}
+			}
+		})
+	}
+}
+
+// the shrinker at work on a level that isn't serializable: the write skews and lost updates random cases run into shrink down to two
+// transactions.
+func TestDifferentialShrinks(t *testing.T) {
+	t.Parallel()
+
+	failures := 0
+	for seed := int64(1); seed <= 200; seed++ {
+		c := generateCase(seed, mvcc.SnapshotIsolation)
+		if c.check() == nil {
+			continue
+		}
+		failures++
+
+		shrunk, err := shrink(c)
+		utils.AssertEq(len(shrunk.txs), 2, fmt.Sprintf("seed %d shrunk to two transactions:\n%v\n%v", seed, shrunk, err))
+		if failures == 1 {
+			t.Logf("seed %d shrunk to:\n%v\n%v", seed, shrunk, err)
+		}
+	}
+	utils.Assert(failures > 0, "snapshot isolation isn't serializable")
+}
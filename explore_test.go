@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mukeshjc/mvcc-isolation/v2/mvcc"
+	"github.com/mukeshjc/mvcc-isolation/v2/utils"
+)
+
+// the programs of the classic anomalies, see anomaly_test.go for the schedules that show them.
+var explorations = []struct {
+	name     string
+	initial  map[string]string
+	programs []mvcc.Program
+	// the levels with non-serializable schedules.
+	allowedBy []mvcc.IsolationLevel
+}{
+	{
+		name:    "lost update",
+		initial: map[string]string{"x": "0"},
+		programs: []mvcc.Program{
+			{{"get", "x"}, {"set", "x", "1"}},
+			{{"get", "x"}, {"set", "x", "2"}},
+		},
+		allowedBy: []mvcc.IsolationLevel{mvcc.ReadUncommittedIsolation, mvcc.ReadCommittedIsolation, mvcc.RepeatableReadIsolation},
+	},
+	{
+		name:    "read skew",
+		initial: map[string]string{"x": "0", "y": "0"},
+		programs: []mvcc.Program{
+			{{"get", "x"}, {"get", "y"}},
+			{{"set", "x", "1"}, {"set", "y", "1"}},
+		},
+		allowedBy: []mvcc.IsolationLevel{mvcc.ReadUncommittedIsolation, mvcc.ReadCommittedIsolation},
+	},
+	{
+		name:    "write skew",
+		initial: map[string]string{"x": "0", "y": "0"},
+		programs: []mvcc.Program{
+			{{"get", "x"}, {"get", "y"}, {"set", "x", "1"}},
+			{{"get", "x"}, {"get", "y"}, {"set", "y", "1"}},
+		},
+		allowedBy: []mvcc.IsolationLevel{
+			mvcc.ReadUncommittedIsolation, mvcc.ReadCommittedIsolation, mvcc.RepeatableReadIsolation, mvcc.SnapshotIsolation,
+		},
+	},
+}
+
+func TestExplore(t *testing.T) {
+	t.Parallel()
+
+	for _, exploration := range explorations {
+		for level := mvcc.ReadUncommittedIsolation; level <= mvcc.TwoPhaseLockingSerializableIsolation; level++ {
+			t.Run(fmt.Sprintf("%s/%v", exploration.name, level), func(t *testing.T) {
+				t.Parallel()
+
+				result := mvcc.Explore(mvcc.ExploreConfig{Level: level, Initial: exploration.initial}, exploration.programs...)
+				t.Log(result)
+
+				allowed := false
+				for _, l := range exploration.allowedBy {
+					allowed = allowed || l == level
+				}
+				utils.AssertEq(result.NonSerializable > 0, allowed, fmt.Sprintf("%v allows %v", level, exploration.name))
+				utils.AssertEq(result.Violated(), false, "no level violates its own guarantees")
+			})
+		}
+	}
+}
+
+// without locks, every interleaving runs to the end: two programs of four commands interleave in 8!/(4!*4!) ways.
+func TestExploreSchedules(t *testing.T) {
+	t.Parallel()
+
+	result := mvcc.Explore(mvcc.ExploreConfig{Level: mvcc.ReadCommittedIsolation, Initial: map[string]string{"x": "0"}}, explorations[0].programs...)
+	utils.AssertEq(result.Schedules, 70, "interleavings")
+
+	// the simplest way to lose an update takes two switches: the second program runs entirely before the first one commits.
+	utils.Assert(len(result.Counterexamples) > 0, "counterexample")
+	utils.AssertEq(result.Counterexamples[0].Schedule.String(), `T1 begin -> "2"
+T1 get x -> "0"
+T1 set x 1 -> "1"
+T2 begin -> "3"
+T2 get x -> "0"
+T2 set x 2 -> "2"
+T2 commit -> ""
+T1 commit -> ""`, "minimal schedule")
+
+	// two-phase locking waits instead, and breaks the deadlock of both upgrading their shared locks by rolling one of them back.
+	result = mvcc.Explore(mvcc.ExploreConfig{Level: mvcc.TwoPhaseLockingSerializableIsolation, Initial: map[string]string{"x": "0"}}, explorations[0].programs...)
+	utils.Assert(result.Schedules < 70, "waiting programs can't be scheduled")
+	utils.AssertEq(result.NonSerializable, 0, "two-phase locking is serializable")
+}
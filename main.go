@@ -1,5 +1,185 @@
 package main
 
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mukeshjc/mvcc-isolation/v2/mvcc"
+)
+
+// a small command line front end for the database. Every line names a connection followed by a command and its arguments:
+//
+//	c1 begin
+//	c2 set x 1
+//	c1 get x
+//
+// connections are created the first time their name is used. Lines starting with '#' and blank lines are ignored.
+// Without a script argument the lines are read interactively from stdin, otherwise the script is replayed and each command echoed with its result.
 func main() {
-	panic("unimplemented")
+	isolation := flag.String("isolation", mvcc.SerializableIsolation.String(), "default isolation level of the database")
+	walPath := flag.String("wal", "", "write-ahead log file, the database is in-memory only when empty")
+	sync := flag.String("sync", "commit", "when to fsync the write-ahead log: never, commit or always")
+	// utils.DEBUG looks at os.Args directly, the flag only exists so that parsing doesn't reject it.
+	flag.Bool("debug", false, "print debug output")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-isolation level] [-wal file [-sync policy]] [--debug] [script]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	level, err := mvcc.ParseIsolationLevel(*isolation)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var opts []mvcc.Option
+	if *walPath != "" {
+		policies := map[string]mvcc.SyncPolicy{"never": mvcc.SyncNever, "commit": mvcc.SyncOnCommit, "always": mvcc.SyncAlways}
+		policy, ok := policies[*sync]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown sync policy %q\n", *sync)
+			os.Exit(2)
+		}
+		opts = append(opts, mvcc.WithWAL(*walPath, policy))
+	}
+
+	db, err := mvcc.OpenDatabase(level, opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	s := newSession(db, os.Stdout)
+
+	if flag.NArg() > 0 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			db.Close()
+			os.Exit(1)
+		}
+		defer f.Close()
+
+		s.echo = true
+		s.run(f)
+		return
+	}
+
+	fmt.Fprintf(os.Stdout, "database open at %s isolation, type 'help' for usage\n", level)
+	s.prompt = "> "
+	s.run(os.Stdin)
+}
+
+type session struct {
+	db          *mvcc.Database
+	connections map[string]*mvcc.Connection
+	out         io.Writer
+
+	// echo every command before its result, useful when replaying a script.
+	echo   bool
+	prompt string
+}
+
+func newSession(db *mvcc.Database, out io.Writer) *session {
+	return &session{
+		db:          db,
+		connections: map[string]*mvcc.Connection{},
+		out:         out,
+	}
+}
+
+func (s *session) run(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(s.out, s.prompt)
+		if !scanner.Scan() {
+			break
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "quit" || line == "exit" {
+			break
+		}
+
+		if s.echo {
+			fmt.Fprintln(s.out, line)
+		}
+		fmt.Fprintln(s.out, s.exec(line))
+	}
+	if s.prompt != "" {
+		fmt.Fprintln(s.out)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(s.out, "error:", err)
+	}
+}
+
+// exec runs a single line and renders its outcome. Errors are part of the output rather than fatal, the whole point is to watch transactions fail.
+func (s *session) exec(line string) (result string) {
+	fields := strings.Fields(line)
+
+	if fields[0] == "help" {
+		return "usage: <connection> <begin|get|getforupdate|set|delete|scan|prefix|commit|rollback|savepoint|release|history> [args...]\n" +
+			"       begin takes an isolation level, or asof <transaction id> to read the past\n" +
+			"       connections lists the open connections, vacuum reclaims dead versions, history <key> shows every version of key, quit exits"
+	}
+
+	if fields[0] == "history" && len(fields) == 2 {
+		if history := mvcc.FormatHistory(s.db.History(fields[1])); history != "" {
+			return history
+		}
+		return "ok"
+	}
+
+	if fields[0] == "vacuum" {
+		stats := s.db.Vacuum()
+		return fmt.Sprintf("horizon %d: removed %d versions, %d keys, %d transactions",
+			stats.Horizon, stats.VersionsRemoved, stats.KeysRemoved, stats.TransactionsRemoved)
+	}
+
+	if fields[0] == "connections" {
+		names := make([]string, 0, len(s.connections))
+		for name := range s.connections {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+
+	if len(fields) < 2 {
+		return fmt.Sprintf("error: expected '<connection> <command> [args...]', got %q", line)
+	}
+
+	name, command, args := fields[0], fields[1], fields[2:]
+	c, ok := s.connections[name]
+	if !ok {
+		c = s.db.NewConnection()
+		s.connections[name] = c
+	}
+
+	// misuse comes back as an error, a panic means an internal invariant broke. Still report it rather than lose the whole session.
+	defer func() {
+		if r := recover(); r != nil {
+			result = fmt.Sprintf("error: %v", r)
+		}
+	}()
+
+	res, err := c.ExecCommand(command, args)
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if res == "" {
+		return "ok"
+	}
+	return res
 }
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/mukeshjc/mvcc-isolation/v2/mvcc"
 	"github.com/mukeshjc/mvcc-isolation/v2/utils"
 )
 
 func TestReadUncommitted(t *testing.T) {
+	t.Parallel()
+
 	database := mvcc.NewDatabase(mvcc.ReadUncommittedIsolation)
 	c1 := database.NewConnection()
 	c1.MustExecCommand("begin", nil)
@@ -31,14 +41,16 @@ func TestReadUncommitted(t *testing.T) {
 
 	res, err := c1.ExecCommand("get", []string{"x"})
 	utils.AssertEq(res, "", "c1 sees no x")
-	utils.AssertEq(err.Error(), "cannot get key that doesn't exist", "c1 sees no x")
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c1 sees no x")
 
 	res, err = c2.ExecCommand("get", []string{"x"})
 	utils.AssertEq(res, "", "c2 sees no x")
-	utils.AssertEq(err.Error(), "cannot get key that doesn't exist", "c2 sees no x")
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c2 sees no x")
 }
 
 func TestReadCommitted(t *testing.T) {
+	t.Parallel()
+
 	database := mvcc.NewDatabase(mvcc.ReadCommittedIsolation)
 	c1 := database.NewConnection()
 	c1.MustExecCommand("begin", nil)
@@ -56,7 +68,7 @@ func TestReadCommitted(t *testing.T) {
 	// committed.
 	res, err := c2.ExecCommand("get", []string{"x"})
 	utils.AssertEq(res, "", "c2 get x")
-	utils.AssertEq(err.Error(), "cannot get key that doesn't exist", "c2 get x")
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c2 get x")
 
 	c1.MustExecCommand("commit", nil)
 
@@ -88,7 +100,7 @@ func TestReadCommitted(t *testing.T) {
 
 	res, err = c2.ExecCommand("get", []string{"x"})
 	utils.AssertEq(res, "", "c2 get x")
-	utils.AssertEq(err.Error(), "cannot get key that doesn't exist", "c2 get x")
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c2 get x")
 
 	c2.MustExecCommand("commit", nil)
 
@@ -99,10 +111,12 @@ func TestReadCommitted(t *testing.T) {
 
 	res, err = c4.ExecCommand("get", []string{"x"})
 	utils.AssertEq(res, "", "c4 get x")
-	utils.AssertEq(err.Error(), "cannot get key that doesn't exist", "c4 get x")
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c4 get x")
 }
 
 func TestRepeatableRead(t *testing.T) {
+	t.Parallel()
+
 	database := mvcc.NewDatabase(mvcc.RepeatableReadIsolation)
 
 	c1 := database.NewConnection()
@@ -119,14 +133,14 @@ func TestRepeatableRead(t *testing.T) {
 	// update not available to this transaction since it is not committed
 	res, err := c2.ExecCommand("get", []string{"x"})
 	utils.AssertEq(res, "", "c2 get x")
-	utils.AssertEq(err.Error(), "cannot get key that doesn't exist", "c2 get x")
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c2 get x")
 
 	c1.MustExecCommand("commit", nil)
 
 	// even after committing the update isn't visible because c1 was in-progress when c2 began
 	res, err = c2.ExecCommand("get", []string{"x"})
 	utils.AssertEq(res, "", "c2 get x")
-	utils.AssertEq(err.Error(), "cannot get key that doesn't exist", "c2 get x")
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c2 get x")
 
 	// but is available in a new transaction
 	c3 := database.NewConnection()
@@ -143,7 +157,7 @@ func TestRepeatableRead(t *testing.T) {
 	// But not on the other connection, again.
 	res, err = c2.ExecCommand("get", []string{"x"})
 	utils.AssertEq(res, "", "c2 get x")
-	utils.AssertEq(err.Error(), "cannot get key that doesn't exist", "c2 get x")
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c2 get x")
 
 	c3.MustExecCommand("rollback", nil)
 
@@ -151,7 +165,7 @@ func TestRepeatableRead(t *testing.T) {
 	// transaction.
 	res, err = c2.ExecCommand("get", []string{"x"})
 	utils.AssertEq(res, "", "c2 get x")
-	utils.AssertEq(err.Error(), "cannot get key that doesn't exist", "c2 get x")
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c2 get x")
 
 	// And again the rollbacked set is still not on a new transaction.
 	c4 := database.NewConnection()
@@ -170,12 +184,14 @@ func TestRepeatableRead(t *testing.T) {
 
 	res, err = c5.ExecCommand("get", []string{"x"})
 	utils.AssertEq(res, "", "c5 get x")
-	utils.AssertEq(err.Error(), "cannot get key that doesn't exist", "c5 get x")
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c5 get x")
 }
 
 // Snapshot Isolation shares all the same visibility rules as Repeatable Read, the tests get to be a little simpler!
 // We'll simply test that two transactions attempting to commit a write to the same key fail. Or specifically: that the second transaction cannot commit.
 func TestSnapshotIsolation(t *testing.T) {
+	t.Parallel()
+
 	database := mvcc.NewDatabase(mvcc.SnapshotIsolation)
 
 	c1 := database.NewConnection()
@@ -194,7 +210,7 @@ func TestSnapshotIsolation(t *testing.T) {
 
 	res, err := c2.ExecCommand("commit", nil)
 	utils.AssertEq(res, "", "c2 commit")
-	utils.AssertEq(err.Error(), "write-write conflict", "c2 commit")
+	utils.Assert(errors.Is(err, mvcc.ErrWriteWriteConflict), "c2 commit")
 
 	// But unrelated keys cause no conflict.
 	c3.MustExecCommand("set", []string{"y", "no conflict"})
@@ -202,6 +218,8 @@ func TestSnapshotIsolation(t *testing.T) {
 }
 
 func TestSerializableIsolation(t *testing.T) {
+	t.Parallel()
+
 	database := mvcc.NewDatabase(mvcc.SerializableIsolation)
 
 	c1 := database.NewConnection()
@@ -217,13 +235,1689 @@ func TestSerializableIsolation(t *testing.T) {
 	c1.MustExecCommand("commit", nil)
 
 	_, err := c2.ExecCommand("get", []string{"x"})
-	utils.AssertEq(err.Error(), "cannot get key that doesn't exist", "c5 get x")
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c5 get x")
 
 	res, err := c2.ExecCommand("commit", nil)
 	utils.AssertEq(res, "", "c2 commit")
-	utils.AssertEq(err.Error(), "read-write or write-write conflict", "c2 commit")
+	utils.Assert(errors.Is(err, mvcc.ErrReadWriteConflict), "c2 commit")
 
 	// But unrelated keys cause no conflict.
 	c3.MustExecCommand("set", []string{"y", "no conflict"})
 	c3.MustExecCommand("commit", nil)
 }
+
+// many connections from separate goroutines hammering the same key. Snapshot Isolation must not lose any committed increment:
+// every transaction that committed successfully read the value left by the previous successful one.
+func TestConcurrentIncrements(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.SnapshotIsolation)
+
+	setup := database.NewConnection()
+	setup.MustExecCommand("begin", nil)
+	setup.MustExecCommand("set", []string{"counter", "0"})
+	setup.MustExecCommand("commit", nil)
+
+	const workers = 8
+	const attempts = 50
+
+	var wg sync.WaitGroup
+	committed := make([]int, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			c := database.NewConnection()
+			for i := 0; i < attempts; i++ {
+				c.MustExecCommand("begin", nil)
+				n, err := strconv.Atoi(c.MustExecCommand("get", []string{"counter"}))
+				if err != nil {
+					panic(err)
+				}
+				c.MustExecCommand("set", []string{"counter", strconv.Itoa(n + 1)})
+				if _, err := c.ExecCommand("commit", nil); err == nil {
+					committed[w]++
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, n := range committed {
+		total += n
+	}
+
+	c := database.NewConnection()
+	c.MustExecCommand("begin", nil)
+	res := c.MustExecCommand("get", []string{"counter"})
+	utils.AssertEq(res, strconv.Itoa(total), "counter matches committed increments")
+}
+
+// goroutines working on disjoint keys never conflict, and each sees exactly what it wrote once committed.
+func TestConcurrentDisjointKeys(t *testing.T) {
+	t.Parallel()
+
+	for _, level := range []mvcc.IsolationLevel{
+		mvcc.ReadUncommittedIsolation,
+		mvcc.ReadCommittedIsolation,
+		mvcc.RepeatableReadIsolation,
+		mvcc.SnapshotIsolation,
+		mvcc.SerializableIsolation,
+	} {
+		database := mvcc.NewDatabase(level)
+
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+
+				c := database.NewConnection()
+				key := fmt.Sprintf("key-%d", w)
+				for i := 0; i < 50; i++ {
+					c.MustExecCommand("begin", nil)
+					c.MustExecCommand("set", []string{key, strconv.Itoa(i)})
+					c.MustExecCommand("commit", nil)
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		c := database.NewConnection()
+		c.MustExecCommand("begin", nil)
+		for w := 0; w < 8; w++ {
+			res := c.MustExecCommand("get", []string{fmt.Sprintf("key-%d", w)})
+			utils.AssertEq(res, "49", fmt.Sprintf("level %d key-%d", level, w))
+		}
+		c.MustExecCommand("commit", nil)
+	}
+}
+
+func TestSessionScript(t *testing.T) {
+	t.Parallel()
+
+	var out strings.Builder
+	s := newSession(mvcc.NewDatabase(mvcc.SnapshotIsolation), &out)
+	s.echo = true
+	s.run(strings.NewReader(`
+# two connections racing on the same key
+c1 begin
+c2 begin
+c1 set x 1
+c2 set x 2
+c1 commit
+c2 commit
+c3 begin
+c3 get x
+c3 get y
+c3 frobnicate
+connections
+`))
+
+	expected := `c1 begin
+1
+c2 begin
+2
+c1 set x 1
+1
+c2 set x 2
+2
+c1 commit
+ok
+c2 commit
+error: write-write conflict: transaction 2 conflicts with transaction 1 on [x]
+c3 begin
+3
+c3 get x
+1
+c3 get y
+error: cannot get key that doesn't exist
+c3 frobnicate
+error: unknown command: frobnicate
+connections
+c1 c2 c3
+`
+	utils.AssertEq(out.String(), expected, "script output")
+}
+
+func TestSerializableSnapshotIsolation(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.SerializableSnapshotIsolation)
+
+	// the history TestSerializableIsolation aborts is fine here: c2 simply serializes before c1.
+	c1 := database.NewConnection()
+	c1.MustExecCommand("begin", nil)
+	c2 := database.NewConnection()
+	c2.MustExecCommand("begin", nil)
+
+	c1.MustExecCommand("set", []string{"x", "hey"})
+	c1.MustExecCommand("commit", nil)
+
+	_, err := c2.ExecCommand("get", []string{"x"})
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c2 get x")
+	c2.MustExecCommand("commit", nil)
+
+	// write skew: each reads what the other writes. c3 -rw-> c4 -rw-> c3 is a dangerous structure, whoever commits second aborts.
+	c3 := database.NewConnection()
+	c3.MustExecCommand("begin", nil)
+	c4 := database.NewConnection()
+	c4.MustExecCommand("begin", nil)
+
+	c3.MustExecCommand("get", []string{"x"})
+	// y doesn't exist yet, reading that is a read all the same.
+	_, err = c4.ExecCommand("get", []string{"y"})
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c4 get y")
+	c3.MustExecCommand("set", []string{"y", "c3"})
+	c4.MustExecCommand("set", []string{"x", "c4"})
+	c3.MustExecCommand("commit", nil)
+
+	res, err := c4.ExecCommand("commit", nil)
+	utils.AssertEq(res, "", "c4 commit")
+	utils.Assert(errors.Is(err, mvcc.ErrRWAntidependency), "c4 commit")
+
+	// write-write conflicts are still first-committer-wins, as under Snapshot Isolation.
+	c5 := database.NewConnection()
+	c5.MustExecCommand("begin", nil)
+	c6 := database.NewConnection()
+	c6.MustExecCommand("begin", nil)
+	c5.MustExecCommand("set", []string{"x", "c5"})
+	c6.MustExecCommand("set", []string{"x", "c6"})
+	c5.MustExecCommand("commit", nil)
+	_, err = c6.ExecCommand("commit", nil)
+	utils.Assert(errors.Is(err, mvcc.ErrWriteWriteConflict), "c6 commit")
+}
+
+// a delete of a key that doesn't exist observed that it doesn't, like a get would have. Two transactions each inserting the key the other
+// one failed to delete is write skew.
+func TestDeleteMissingKeyIsARead(t *testing.T) {
+	t.Parallel()
+
+	for _, level := range []mvcc.IsolationLevel{mvcc.SerializableIsolation, mvcc.SerializableSnapshotIsolation} {
+		database := mvcc.NewDatabase(level)
+
+		c1 := database.NewConnection()
+		c1.MustExecCommand("begin", nil)
+		c2 := database.NewConnection()
+		c2.MustExecCommand("begin", nil)
+
+		c1.MustExecCommand("set", []string{"x", "1"})
+		c2.MustExecCommand("set", []string{"y", "2"})
+		_, err := c1.ExecCommand("delete", []string{"y"})
+		utils.Assert(errors.Is(err, mvcc.ErrNotFound), fmt.Sprintf("%v: c1 delete y", level))
+		_, err = c2.ExecCommand("delete", []string{"x"})
+		utils.Assert(errors.Is(err, mvcc.ErrNotFound), fmt.Sprintf("%v: c2 delete x", level))
+
+		c1.MustExecCommand("commit", nil)
+		_, err = c2.ExecCommand("commit", nil)
+		utils.Assert(errors.Is(err, mvcc.ErrSerialization), fmt.Sprintf("%v: c2 commit", level))
+	}
+}
+
+// in -rw-> pivot -rw-> out with out committing first. The pivot is the one aborted, at its commit.
+func TestSerializableSnapshotIsolationPivot(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.SerializableSnapshotIsolation)
+
+	setup := database.NewConnection()
+	setup.MustExecCommand("begin", nil)
+	setup.MustExecCommand("set", []string{"x", "0"})
+	setup.MustExecCommand("set", []string{"y", "0"})
+	setup.MustExecCommand("commit", nil)
+
+	in := database.NewConnection()
+	in.MustExecCommand("begin", nil)
+	pivot := database.NewConnection()
+	pivot.MustExecCommand("begin", nil)
+	out := database.NewConnection()
+	out.MustExecCommand("begin", nil)
+
+	// pivot -rw-> out.
+	pivot.MustExecCommand("get", []string{"x"})
+	out.MustExecCommand("set", []string{"x", "out"})
+	out.MustExecCommand("commit", nil)
+
+	// in -rw-> pivot.
+	in.MustExecCommand("get", []string{"y"})
+	pivot.MustExecCommand("set", []string{"y", "pivot"})
+
+	_, err := pivot.ExecCommand("commit", nil)
+	utils.Assert(errors.Is(err, mvcc.ErrRWAntidependency), "pivot commit")
+	in.MustExecCommand("commit", nil)
+
+	// the same dependencies, but the pivot commits before out. Out didn't commit first, the serial order in, pivot, out explains the history
+	// and nobody aborts.
+	in.MustExecCommand("begin", nil)
+	pivot.MustExecCommand("begin", nil)
+	out.MustExecCommand("begin", nil)
+
+	pivot.MustExecCommand("get", []string{"x"})
+	out.MustExecCommand("set", []string{"x", "out again"})
+	in.MustExecCommand("get", []string{"y"})
+	pivot.MustExecCommand("set", []string{"y", "pivot"})
+	pivot.MustExecCommand("commit", nil)
+	out.MustExecCommand("commit", nil)
+	in.MustExecCommand("commit", nil)
+}
+
+// the same workload of read-modify-write transactions on overlapping keys, run under both serializable modes.
+// each transaction reads two keys and writes one of them: an rw-antidependency on the other key is harmless unless it closes a dangerous structure,
+// so serializable snapshot isolation aborts fewer of them.
+func TestSerializableAbortRates(t *testing.T) {
+	t.Parallel()
+
+	aborts := func(level mvcc.IsolationLevel) int {
+		database := mvcc.NewDatabase(level)
+
+		setup := database.NewConnection()
+		setup.MustExecCommand("begin", nil)
+		for k := 0; k < 4; k++ {
+			setup.MustExecCommand("set", []string{fmt.Sprintf("k%d", k), "0"})
+		}
+		setup.MustExecCommand("commit", nil)
+
+		aborted := 0
+		// waves of 3 overlapping transactions: connection i reads k(i) and k(i+1), writes k(i).
+		for wave := 0; wave < 10; wave++ {
+			connections := make([]*mvcc.Connection, 3)
+			for i := range connections {
+				connections[i] = database.NewConnection()
+				connections[i].MustExecCommand("begin", nil)
+			}
+			for i, c := range connections {
+				key := fmt.Sprintf("k%d", (i+wave)%4)
+				other := fmt.Sprintf("k%d", (i+wave+1)%4)
+				c.MustExecCommand("get", []string{key})
+				c.MustExecCommand("get", []string{other})
+				c.MustExecCommand("set", []string{key, strconv.Itoa(wave)})
+			}
+			for _, c := range connections {
+				if _, err := c.ExecCommand("commit", nil); err != nil {
+					aborted++
+				}
+			}
+		}
+		return aborted
+	}
+
+	conservative := aborts(mvcc.SerializableIsolation)
+	ssi := aborts(mvcc.SerializableSnapshotIsolation)
+	t.Logf("aborts: serializable %d, serializable snapshot %d", conservative, ssi)
+	utils.Assert(ssi < conservative, fmt.Sprintf("serializable snapshot isolation aborted %d, serializable %d", ssi, conservative))
+}
+
+func TestScan(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.RepeatableReadIsolation)
+
+	setup := database.NewConnection()
+	setup.MustExecCommand("begin", nil)
+	for _, key := range []string{"c", "b3", "a", "b1", "b2"} {
+		setup.MustExecCommand("set", []string{key, "v" + key})
+	}
+	setup.MustExecCommand("commit", nil)
+
+	c1 := database.NewConnection()
+	c1.MustExecCommand("begin", nil)
+
+	// concurrent changes: an insert inside the range, a delete and an update, all committed after c1 began.
+	c2 := database.NewConnection()
+	c2.MustExecCommand("begin", nil)
+	c2.MustExecCommand("set", []string{"b4", "vb4"})
+	c2.MustExecCommand("delete", []string{"b2"})
+	c2.MustExecCommand("set", []string{"b3", "changed"})
+	c2.MustExecCommand("commit", nil)
+
+	// c1's own writes are visible to its scans.
+	c1.MustExecCommand("set", []string{"b0", "vb0"})
+
+	res := c1.MustExecCommand("prefix", []string{"b"})
+	utils.AssertEq(res, "b0=vb0\nb1=vb1\nb2=vb2\nb3=vb3", "c1 prefix b")
+
+	// end is exclusive.
+	res = c1.MustExecCommand("scan", []string{"a", "b2"})
+	utils.AssertEq(res, "a=va\nb0=vb0\nb1=vb1", "c1 scan a b2")
+
+	// no end scans to the last key.
+	res = c1.MustExecCommand("scan", []string{"b25"})
+	utils.AssertEq(res, "b3=vb3\nc=vc", "c1 scan b25")
+
+	res = c1.MustExecCommand("scan", []string{"x", "z"})
+	utils.AssertEq(res, "", "c1 scan x z")
+	c1.MustExecCommand("commit", nil)
+
+	// a new transaction sees c2's changes.
+	c3 := database.NewConnection()
+	c3.MustExecCommand("begin", nil)
+	res = c3.MustExecCommand("prefix", []string{"b"})
+	utils.AssertEq(res, "b0=vb0\nb1=vb1\nb3=changed\nb4=vb4", "c3 prefix b")
+}
+
+// the classic phantom: two transactions each check that a room has no booking for a slot by scanning for it, then each books it.
+// neither writes a key the other read, only a key inside a range the other scanned.
+func TestPhantom(t *testing.T) {
+	t.Parallel()
+
+	book := func(level mvcc.IsolationLevel) (string, error) {
+		database := mvcc.NewDatabase(level)
+
+		c1 := database.NewConnection()
+		c1.MustExecCommand("begin", nil)
+		c2 := database.NewConnection()
+		c2.MustExecCommand("begin", nil)
+
+		utils.AssertEq(c1.MustExecCommand("prefix", []string{"room1/"}), "", "c1 room1 is free")
+		utils.AssertEq(c2.MustExecCommand("scan", []string{"room1/", "room1/~"}), "", "c2 room1 is free")
+
+		c1.MustExecCommand("set", []string{"room1/alice", "booked"})
+		c2.MustExecCommand("set", []string{"room1/bob", "booked"})
+
+		c1.MustExecCommand("commit", nil)
+		_, err := c2.ExecCommand("commit", nil)
+
+		c3 := database.NewConnection()
+		c3.MustExecCommand("begin", nil)
+		return c3.MustExecCommand("prefix", []string{"room1/"}), err
+	}
+
+	// allowed: both bookings committed.
+	for _, level := range []mvcc.IsolationLevel{mvcc.RepeatableReadIsolation, mvcc.SnapshotIsolation} {
+		bookings, err := book(level)
+		utils.AssertEq(err, nil, level.String()+" c2 commit")
+		utils.AssertEq(bookings, "room1/alice=booked\nroom1/bob=booked", level.String()+" bookings")
+	}
+
+	// prevented: the second booking aborts.
+	bookings, err := book(mvcc.SerializableIsolation)
+	utils.Assert(errors.Is(err, mvcc.ErrReadWriteConflict), "serializable c2 commit")
+	utils.AssertEq(bookings, "room1/alice=booked", "serializable bookings")
+
+	bookings, err = book(mvcc.SerializableSnapshotIsolation)
+	utils.Assert(errors.Is(err, mvcc.ErrRWAntidependency), "serializable snapshot c2 commit")
+	utils.AssertEq(bookings, "room1/alice=booked", "serializable snapshot bookings")
+}
+
+// the details of an error are available to callers without parsing its text.
+func TestErrors(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.SerializableIsolation)
+
+	c1 := database.NewConnection()
+	c1.MustExecCommand("begin", nil)
+	c2 := database.NewConnection()
+	c2.MustExecCommand("begin", nil)
+
+	_, err := c1.ExecCommand("delete", []string{"x"})
+	var notFound *mvcc.NotFoundError
+	utils.Assert(errors.As(err, &notFound), "c1 delete x is a not found error")
+	utils.AssertEq(notFound.Command, "delete", "not found command")
+	utils.AssertEq(notFound.Key, "x", "not found key")
+	utils.Assert(!errors.Is(err, mvcc.ErrSerialization), "not found is not a serialization failure")
+
+	c1.MustExecCommand("set", []string{"x", "1"})
+	c1.MustExecCommand("set", []string{"y", "1"})
+	c1.MustExecCommand("commit", nil)
+
+	_, err = c2.ExecCommand("get", []string{"y"})
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c2 get y")
+	c2.MustExecCommand("set", []string{"x", "2"})
+	_, err = c2.ExecCommand("commit", nil)
+
+	var conflict *mvcc.ConflictError
+	utils.Assert(errors.As(err, &conflict), "c2 commit is a conflict error")
+	utils.Assert(errors.Is(err, mvcc.ErrSerialization), "conflicts are serialization failures")
+	utils.Assert(errors.Is(err, mvcc.ErrReadWriteConflict), "serializable conflicts are read-write conflicts")
+	utils.Assert(!errors.Is(err, mvcc.ErrWriteWriteConflict), "but not write-write conflicts")
+	utils.AssertEq(conflict.Kind, mvcc.ReadWriteConflict, "conflict kind")
+	utils.AssertEq(conflict.TxId, uint64(2), "conflict transaction")
+	utils.AssertEq(conflict.OtherTxId, uint64(1), "conflict other transaction")
+	utils.AssertEq(fmt.Sprint(conflict.Keys), "[x y]", "conflict keys")
+}
+
+// misusing a connection comes back as an error and leaves the connection (and every other one) usable.
+func TestInvalidCommands(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.SnapshotIsolation)
+	c := database.NewConnection()
+
+	_, err := c.ExecCommand("get", []string{"x"})
+	utils.Assert(errors.Is(err, mvcc.ErrNoTransaction), "get before begin")
+	_, err = c.ExecCommand("commit", nil)
+	utils.Assert(errors.Is(err, mvcc.ErrNoTransaction), "commit before begin")
+	_, err = c.ExecCommand("frobnicate", nil)
+	utils.Assert(errors.Is(err, mvcc.ErrUnknownCommand), "unknown command")
+
+	c.MustExecCommand("begin", nil)
+	_, err = c.ExecCommand("begin", nil)
+	utils.Assert(errors.Is(err, mvcc.ErrTransactionInProgress), "begin twice")
+
+	for _, tc := range []struct {
+		command string
+		args    []string
+	}{
+		{"get", nil},
+		{"get", []string{"x", "y"}},
+		{"set", []string{"x"}},
+		{"delete", []string{}},
+		{"scan", nil},
+		{"prefix", []string{"a", "b"}},
+		{"commit", []string{"now"}},
+	} {
+		_, err = c.ExecCommand(tc.command, tc.args)
+		var argErr *mvcc.ArgumentError
+		utils.Assert(errors.As(err, &argErr), tc.command+" wrong arguments")
+		utils.AssertEq(argErr.Command, tc.command, "argument error command")
+		utils.AssertEq(argErr.Got, len(tc.args), "argument error count")
+		utils.Assert(errors.Is(err, mvcc.ErrInvalidArguments), tc.command+" is invalid arguments")
+		utils.Assert(errors.Is(err, mvcc.ErrInvalidCommand), tc.command+" is an invalid command")
+		utils.Assert(!errors.Is(err, mvcc.ErrSerialization), tc.command+" is not a serialization failure")
+	}
+
+	// the transaction is still good.
+	c.MustExecCommand("set", []string{"x", "1"})
+	c.MustExecCommand("commit", nil)
+	_, err = c.ExecCommand("rollback", nil)
+	utils.Assert(errors.Is(err, mvcc.ErrNoTransaction), "rollback after commit")
+
+	c.MustExecCommand("begin", nil)
+	utils.AssertEq(c.MustExecCommand("get", []string{"x"}), "1", "get x")
+	c.MustExecCommand("commit", nil)
+}
+
+// transactions at different isolation levels on one database: each reads by its own rules and is checked by its own rules at commit.
+func TestMixedIsolationLevels(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.SerializableIsolation)
+
+	setup := database.NewConnection()
+	setup.MustExecCommand("begin", nil)
+	setup.MustExecCommand("set", []string{"x", "0"})
+	setup.MustExecCommand("commit", nil)
+
+	writer := database.NewConnection()
+	writer.MustExecCommand("begin", []string{"serializable"})
+
+	reporting := database.NewConnection()
+	_, err := reporting.Begin(mvcc.ReadCommittedIsolation)
+	utils.AssertEq(err, nil, "reporting begin")
+
+	dirty := database.NewConnection()
+	dirty.MustExecCommand("begin", []string{"read-uncommitted"})
+
+	snapshot := database.NewConnection()
+	snapshot.MustExecCommand("begin", []string{"repeatable-read"})
+
+	writer.MustExecCommand("set", []string{"x", "1"})
+
+	// only read uncommitted sees the uncommitted write.
+	utils.AssertEq(dirty.MustExecCommand("get", []string{"x"}), "1", "dirty get x")
+	utils.AssertEq(reporting.MustExecCommand("get", []string{"x"}), "0", "reporting get x")
+	utils.AssertEq(snapshot.MustExecCommand("get", []string{"x"}), "0", "snapshot get x")
+
+	writer.MustExecCommand("commit", nil)
+
+	// read committed sees the commit in its next statement, repeatable read keeps its snapshot.
+	utils.AssertEq(reporting.MustExecCommand("get", []string{"x"}), "1", "reporting get x")
+	utils.AssertEq(snapshot.MustExecCommand("get", []string{"x"}), "0", "snapshot get x")
+
+	for _, c := range []*mvcc.Connection{reporting, dirty, snapshot} {
+		c.MustExecCommand("commit", nil)
+	}
+
+	// a read committed transaction that committed a write first makes a concurrent snapshot writer of the same key fail...
+	rc := database.NewConnection()
+	rc.MustExecCommand("begin", []string{"read-committed"})
+	si := database.NewConnection()
+	si.MustExecCommand("begin", []string{"snapshot"})
+	rc.MustExecCommand("set", []string{"x", "rc"})
+	si.MustExecCommand("set", []string{"x", "si"})
+	rc.MustExecCommand("commit", nil)
+	_, err = si.ExecCommand("commit", nil)
+	utils.Assert(errors.Is(err, mvcc.ErrWriteWriteConflict), "si commit after rc")
+
+	// ...but when the snapshot writer commits first, read committed doesn't check and overwrites it.
+	rc.MustExecCommand("begin", []string{"read-committed"})
+	si.MustExecCommand("begin", []string{"snapshot"})
+	rc.MustExecCommand("set", []string{"x", "rc"})
+	si.MustExecCommand("set", []string{"x", "si"})
+	si.MustExecCommand("commit", nil)
+	rc.MustExecCommand("commit", nil)
+
+	// the database default is still serializable.
+	c := database.NewConnection()
+	c.MustExecCommand("begin", nil)
+	c2 := database.NewConnection()
+	c2.MustExecCommand("begin", nil)
+	_, err = c.ExecCommand("get", []string{"z"})
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c get z")
+	c2.MustExecCommand("set", []string{"z", "c2"})
+	c2.MustExecCommand("commit", nil)
+	c.MustExecCommand("set", []string{"y", "c"})
+	_, err = c.ExecCommand("commit", nil)
+	utils.Assert(errors.Is(err, mvcc.ErrReadWriteConflict), "serializable default")
+
+	// only serializable transactions take part in each other's read/write checks, a read committed writer of a key a serializable one read
+	// doesn't make it fail. Writing the same key still does.
+	c.MustExecCommand("begin", nil)
+	rc.MustExecCommand("begin", []string{"read-committed"})
+	utils.AssertEq(c.MustExecCommand("get", []string{"z"}), "c2", "c get z")
+	rc.MustExecCommand("set", []string{"z", "rc"})
+	rc.MustExecCommand("commit", nil)
+	c.MustExecCommand("set", []string{"y", "c"})
+	c.MustExecCommand("commit", nil)
+
+	c.MustExecCommand("begin", nil)
+	rc.MustExecCommand("begin", []string{"read-committed"})
+	c.MustExecCommand("set", []string{"y", "c"})
+	rc.MustExecCommand("set", []string{"y", "rc"})
+	rc.MustExecCommand("commit", nil)
+	_, err = c.ExecCommand("commit", nil)
+	utils.Assert(errors.Is(err, mvcc.ErrSerialization), "serializable commit after a read committed write of y")
+
+	_, err = c.ExecCommand("begin", []string{"chaotic"})
+	utils.Assert(errors.Is(err, mvcc.ErrUnknownIsolationLevel), "unknown isolation level")
+	utils.Assert(errors.Is(err, mvcc.ErrInvalidCommand), "unknown isolation level is an invalid command")
+}
+
+// the Go API: any number of transactions open in one goroutine, no connections or string commands involved.
+func TestTx(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.SnapshotIsolation)
+
+	setup, err := database.Begin(mvcc.TxOptions{})
+	utils.AssertEq(err, nil, "begin setup")
+	utils.AssertEq(setup.Isolation(), mvcc.SnapshotIsolation, "zero options use the database default")
+	for _, key := range []string{"a", "b", "c"} {
+		utils.AssertEq(setup.Set(key, key+"0"), nil, "setup set")
+	}
+	utils.AssertEq(setup.Commit(), nil, "setup commit")
+
+	t1, err := database.Begin(mvcc.TxOptions{})
+	utils.AssertEq(err, nil, "begin t1")
+	readCommitted := mvcc.ReadCommittedIsolation
+	t2, err := database.Begin(mvcc.TxOptions{Isolation: &readCommitted})
+	utils.AssertEq(err, nil, "begin t2")
+	utils.AssertEq(t2.Isolation(), mvcc.ReadCommittedIsolation, "t2 isolation")
+
+	utils.AssertEq(t1.Set("a", "a1"), nil, "t1 set a")
+	utils.AssertEq(t1.Delete("b"), nil, "t1 delete b")
+
+	// t2 doesn't see t1's writes until it commits, and sees them right after.
+	value, err := t2.Get("a")
+	utils.AssertEq(err, nil, "t2 get a")
+	utils.AssertEq(value, "a0", "t2 get a")
+	utils.AssertEq(t1.Commit(), nil, "t1 commit")
+
+	value, err = t2.Get("a")
+	utils.AssertEq(err, nil, "t2 get a")
+	utils.AssertEq(value, "a1", "t2 get a after commit")
+	_, err = t2.Get("b")
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "t2 get b after delete")
+
+	kvs, err := t2.Scan("a", "")
+	utils.AssertEq(err, nil, "t2 scan")
+	utils.AssertEq(fmt.Sprint(kvs), "[{a a1} {c c0}]", "t2 scan")
+	kvs, err = t2.Prefix("c")
+	utils.AssertEq(err, nil, "t2 prefix")
+	utils.AssertEq(fmt.Sprint(kvs), "[{c c0}]", "t2 prefix")
+
+	utils.AssertEq(t2.Rollback(), nil, "t2 rollback")
+
+	// a finished transaction can't be used anymore.
+	for _, err := range []error{
+		t1.Set("a", "a2"),
+		t1.Commit(),
+		t2.Rollback(),
+		t2.Delete("a"),
+	} {
+		utils.Assert(errors.Is(err, mvcc.ErrTransactionDone), "finished transaction")
+		utils.Assert(errors.Is(err, mvcc.ErrInvalidCommand), "finished transaction")
+	}
+	_, err = t1.Get("a")
+	utils.Assert(errors.Is(err, mvcc.ErrTransactionDone), "get after commit")
+
+	// conflicts surface from commit, like through a connection.
+	t3, _ := database.Begin(mvcc.TxOptions{})
+	t4, _ := database.Begin(mvcc.TxOptions{})
+	utils.AssertEq(t3.Set("c", "c3"), nil, "t3 set c")
+	utils.AssertEq(t4.Set("c", "c4"), nil, "t4 set c")
+	utils.AssertEq(t3.Commit(), nil, "t3 commit")
+	utils.Assert(errors.Is(t4.Commit(), mvcc.ErrWriteWriteConflict), "t4 commit")
+
+	unknown := mvcc.IsolationLevel(42)
+	_, err = database.Begin(mvcc.TxOptions{Isolation: &unknown})
+	utils.Assert(errors.Is(err, mvcc.ErrUnknownIsolationLevel), "begin unknown level")
+	_, err = mvcc.OpenDatabase(unknown)
+	utils.Assert(errors.Is(err, mvcc.ErrUnknownIsolationLevel), "open with unknown level")
+}
+
+// retrying every conflict, concurrent increments never lose an update and all of them commit.
+func TestRunInTransaction(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.SnapshotIsolation)
+	opts := mvcc.RetryOptions{MaxAttempts: 1000, Backoff: 10 * time.Microsecond, MaxBackoff: time.Millisecond, Jitter: 0.5}
+
+	increment := func(tx *mvcc.Tx) error {
+		n := 0
+		value, err := tx.Get("counter")
+		if err == nil {
+			n, err = strconv.Atoi(value)
+		}
+		if err != nil && !errors.Is(err, mvcc.ErrNotFound) {
+			return err
+		}
+		return tx.Set("counter", strconv.Itoa(n+1))
+	}
+
+	const workers = 8
+	const increments = 25
+
+	var wg sync.WaitGroup
+	var retried atomic.Int64
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				attempts, err := database.RunInTransaction(context.Background(), opts, increment)
+				utils.AssertEq(err, nil, "increment")
+				retried.Add(int64(attempts - 1))
+			}
+		}()
+	}
+	wg.Wait()
+	t.Logf("%d retries", retried.Load())
+
+	database.RunInTransaction(context.Background(), mvcc.RetryOptions{}, func(tx *mvcc.Tx) error {
+		value, err := tx.Get("counter")
+		utils.AssertEq(err, nil, "get counter")
+		utils.AssertEq(value, strconv.Itoa(workers*increments), "every increment committed once")
+		return nil
+	})
+
+	// a conflict on the first attempt is retried against a fresh snapshot.
+	first := true
+	attempts, err := database.RunInTransaction(context.Background(), opts, func(tx *mvcc.Tx) error {
+		if err := increment(tx); err != nil {
+			return err
+		}
+		if first {
+			first = false
+			attempts, err := database.RunInTransaction(context.Background(), opts, increment)
+			utils.AssertEq(attempts, 1, "concurrent increment attempts")
+			utils.AssertEq(err, nil, "concurrent increment")
+		}
+		return nil
+	})
+	utils.AssertEq(attempts, 2, "attempts")
+	utils.AssertEq(err, nil, "retried increment")
+
+	// errors of the function itself are returned right away, and its writes rolled back.
+	errBoom := errors.New("boom")
+	attempts, err = database.RunInTransaction(context.Background(), opts, func(tx *mvcc.Tx) error {
+		tx.Set("counter", "boom")
+		return errBoom
+	})
+	utils.AssertEq(attempts, 1, "attempts")
+	utils.Assert(errors.Is(err, errBoom), "user error returned")
+
+	// a transaction that always conflicts gives up after MaxAttempts.
+	attempts, err = database.RunInTransaction(context.Background(), mvcc.RetryOptions{MaxAttempts: 3}, func(tx *mvcc.Tx) error {
+		if err := increment(tx); err != nil {
+			return err
+		}
+		_, err := database.RunInTransaction(context.Background(), opts, increment)
+		return err
+	})
+	utils.AssertEq(attempts, 3, "attempts")
+	utils.Assert(errors.Is(err, mvcc.ErrWriteWriteConflict), "last conflict returned")
+
+	// and a cancelled context stops retrying.
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts, err = database.RunInTransaction(ctx, mvcc.RetryOptions{Backoff: time.Hour}, func(tx *mvcc.Tx) error {
+		if err := increment(tx); err != nil {
+			return err
+		}
+		cancel()
+		_, err := database.RunInTransaction(context.Background(), opts, increment)
+		return err
+	})
+	utils.AssertEq(attempts, 1, "attempts")
+	utils.Assert(errors.Is(err, context.Canceled), "context error returned")
+
+	// on top of the workers: the retried increment and its concurrent one, the three concurrent increments that made
+	// every attempt conflict, and the one that made the cancelled attempt conflict.
+	database.RunInTransaction(context.Background(), mvcc.RetryOptions{}, func(tx *mvcc.Tx) error {
+		value, _ := tx.Get("counter")
+		utils.AssertEq(value, strconv.Itoa(workers*increments+6), "counter")
+		return nil
+	})
+}
+
+func TestSavepoints(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.SnapshotIsolation)
+
+	c1 := database.NewConnection()
+	c1.MustExecCommand("begin", nil)
+	c1.MustExecCommand("set", []string{"x", "0"})
+	c1.MustExecCommand("set", []string{"y", "0"})
+	c1.MustExecCommand("commit", nil)
+
+	c1.MustExecCommand("begin", nil)
+	c1.MustExecCommand("set", []string{"x", "1"})
+	c1.MustExecCommand("savepoint", []string{"a"})
+	c1.MustExecCommand("set", []string{"x", "2"})
+	c1.MustExecCommand("delete", []string{"y"})
+	c1.MustExecCommand("savepoint", []string{"b"})
+	c1.MustExecCommand("set", []string{"z", "3"})
+	utils.AssertEq(c1.MustExecCommand("get", []string{"x"}), "2", "c1 get x")
+
+	// back to b: only z is undone.
+	c1.MustExecCommand("rollback", []string{"to", "b"})
+	_, err := c1.ExecCommand("get", []string{"z"})
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c1 get z after rollback to b")
+	_, err = c1.ExecCommand("get", []string{"y"})
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c1 get y after rollback to b")
+
+	// back to a: the second write of x and the delete of y are undone, the first write of x stays.
+	c1.MustExecCommand("rollback", []string{"to", "a"})
+	utils.AssertEq(c1.MustExecCommand("get", []string{"x"}), "1", "c1 get x after rollback to a")
+	utils.AssertEq(c1.MustExecCommand("get", []string{"y"}), "0", "c1 get y after rollback to a")
+
+	// b was taken after a, it is gone. a itself remains and can be rolled back to again.
+	_, err = c1.ExecCommand("rollback", []string{"to", "b"})
+	utils.Assert(errors.Is(err, mvcc.ErrNoSavepoint), "rollback to b after rollback to a")
+	c1.MustExecCommand("set", []string{"y", "4"})
+	c1.MustExecCommand("rollback", []string{"to", "a"})
+	utils.AssertEq(c1.MustExecCommand("get", []string{"y"}), "0", "c1 get y after second rollback to a")
+
+	// released savepoints can't be rolled back to, but the work done since them stays.
+	c1.MustExecCommand("savepoint", []string{"c"})
+	c1.MustExecCommand("set", []string{"z", "5"})
+	c1.MustExecCommand("release", []string{"a"})
+	_, err = c1.ExecCommand("rollback", []string{"to", "c"})
+	utils.Assert(errors.Is(err, mvcc.ErrNoSavepoint), "rollback to c after releasing a")
+
+	// y was only written after the savepoint, so a concurrent writer of y doesn't conflict with c1.
+	c2 := database.NewConnection()
+	c2.MustExecCommand("begin", nil)
+	c2.MustExecCommand("set", []string{"y", "c2"})
+	c2.MustExecCommand("commit", nil)
+	c1.MustExecCommand("commit", nil)
+
+	c2.MustExecCommand("begin", nil)
+	utils.AssertEq(c2.MustExecCommand("get", []string{"x"}), "1", "c2 get x")
+	utils.AssertEq(c2.MustExecCommand("get", []string{"y"}), "c2", "c2 get y")
+	utils.AssertEq(c2.MustExecCommand("get", []string{"z"}), "5", "c2 get z")
+
+	_, err = c2.ExecCommand("rollback", []string{"to"})
+	utils.Assert(errors.Is(err, mvcc.ErrInvalidArguments), "rollback to without a name")
+	_, err = c2.ExecCommand("rollback", []string{"from", "a"})
+	utils.Assert(errors.Is(err, mvcc.ErrInvalidArguments), "rollback from")
+	_, err = c2.ExecCommand("release", []string{"a"})
+	utils.Assert(errors.Is(err, mvcc.ErrNoSavepoint), "release unknown savepoint")
+	c2.MustExecCommand("commit", nil)
+}
+
+// without blocking writes two transactions can end the same version. A delete that committed stays a delete, whatever the other one does.
+func TestVersionEndedTwice(t *testing.T) {
+	t.Parallel()
+
+	assertDeleted := func(database *mvcc.Database, msg string) {
+		for _, level := range []mvcc.IsolationLevel{mvcc.ReadCommittedIsolation, mvcc.RepeatableReadIsolation} {
+			c := database.NewConnection()
+			_, err := c.Begin(level)
+			utils.AssertEq(err, nil, "begin")
+			_, err = c.ExecCommand("get", []string{"x"})
+			utils.Assert(errors.Is(err, mvcc.ErrNotFound), fmt.Sprintf("%s: %v get x", msg, level))
+			c.MustExecCommand("commit", nil)
+		}
+	}
+
+	// the second writer began before the delete committed, so it still sees the version and ends it again.
+	t.Run("repeatable read", func(t *testing.T) {
+		t.Parallel()
+
+		database := mvcc.NewDatabase(mvcc.RepeatableReadIsolation)
+		c0 := database.NewConnection()
+		c0.MustExecCommand("begin", nil)
+		c0.MustExecCommand("set", []string{"x", "v0"})
+		c0.MustExecCommand("commit", nil)
+
+		c2 := database.NewConnection()
+		c2.MustExecCommand("begin", nil)
+		c1 := database.NewConnection()
+		c1.MustExecCommand("begin", nil)
+		c1.MustExecCommand("delete", []string{"x"})
+		c1.MustExecCommand("commit", nil)
+
+		c2.MustExecCommand("set", []string{"x", "v2"})
+		assertDeleted(database, "c2 in progress")
+		c2.MustExecCommand("rollback", nil)
+		assertDeleted(database, "c2 rolled back")
+		database.Vacuum()
+		assertDeleted(database, "vacuumed")
+	})
+
+	// the first delete committing and the second rolling back leaves the key deleted.
+	t.Run("read committed", func(t *testing.T) {
+		t.Parallel()
+
+		database := mvcc.NewDatabase(mvcc.ReadCommittedIsolation)
+		c0 := database.NewConnection()
+		c0.MustExecCommand("begin", nil)
+		c0.MustExecCommand("set", []string{"x", "v0"})
+		c0.MustExecCommand("commit", nil)
+
+		c1 := database.NewConnection()
+		c1.MustExecCommand("begin", nil)
+		c1.MustExecCommand("delete", []string{"x"})
+		c3 := database.NewConnection()
+		c3.MustExecCommand("begin", nil)
+		c3.MustExecCommand("delete", []string{"x"})
+
+		c1.MustExecCommand("commit", nil)
+		c3.MustExecCommand("rollback", nil)
+		assertDeleted(database, "c3 rolled back")
+		database.Vacuum()
+		assertDeleted(database, "vacuumed")
+	})
+}
+
+func TestTimeTravel(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.SnapshotIsolation)
+
+	// transactions 1 to 3.
+	for i := 1; i <= 3; i++ {
+		update(database, "x", strconv.Itoa(i))
+	}
+
+	// transaction 4 is still running while 5 deletes x and 6 sets y.
+	slow := database.NewConnection()
+	slow.MustExecCommand("begin", nil)
+	slow.MustExecCommand("set", []string{"y", "slow"})
+	c := database.NewConnection()
+	c.MustExecCommand("begin", nil)
+	c.MustExecCommand("delete", []string{"x"})
+	c.MustExecCommand("commit", nil)
+	update(database, "z", "6")
+	slow.MustExecCommand("commit", nil)
+
+	asOf := func(id string, key string) string {
+		c := database.NewConnection()
+		c.MustExecCommand("begin", []string{"asof", id})
+		defer c.MustExecCommand("commit", nil)
+		res, err := c.ExecCommand("get", []string{key})
+		if errors.Is(err, mvcc.ErrNotFound) {
+			return "<none>"
+		}
+		utils.AssertEq(err, nil, "get as of "+id)
+		return res
+	}
+
+	for i, expected := range []string{"1", "2", "3", "3", "<none>", "<none>"} {
+		id := strconv.Itoa(i + 1)
+		utils.AssertEq(asOf(id, "x"), expected, "x as of "+id)
+	}
+	// transaction 4 was in progress when 5 and 6 began, so their snapshots don't have y even though it has committed by now.
+	utils.AssertEq(asOf("4", "y"), "slow", "y as of 4")
+	utils.AssertEq(asOf("5", "y"), "<none>", "y as of 5")
+	utils.AssertEq(asOf("6", "y"), "<none>", "y as of 6")
+	utils.AssertEq(asOf("6", "z"), "6", "z as of 6")
+
+	// scans travel in time too, and nothing can be written.
+	c.MustExecCommand("begin", []string{"asof", "3"})
+	utils.AssertEq(c.MustExecCommand("scan", []string{"a"}), "x=3", "scan as of 3")
+	_, err := c.ExecCommand("set", []string{"x", "rewritten"})
+	utils.Assert(errors.Is(err, mvcc.ErrReadOnlyTransaction), "set as of 3")
+	_, err = c.ExecCommand("delete", []string{"x"})
+	utils.Assert(errors.Is(err, mvcc.ErrReadOnlyTransaction), "delete as of 3")
+
+	// while it runs, vacuum keeps what it sees.
+	database.Vacuum()
+	utils.AssertEq(c.MustExecCommand("get", []string{"x"}), "3", "get as of 3 after vacuum")
+	c.MustExecCommand("commit", nil)
+
+	// once vacuum removed the history, reading it fails instead of returning a wrong answer.
+	database.Vacuum()
+	_, err = c.ExecCommand("begin", []string{"asof", "3"})
+	utils.Assert(errors.Is(err, mvcc.ErrSnapshotTooOld), "begin as of 3 after vacuum")
+
+	// the history after the horizon is still there.
+	tx, err := database.Begin(mvcc.TxOptions{})
+	utils.AssertEq(err, nil, "begin")
+	utils.AssertEq(tx.Set("x", "back"), nil, "set x")
+	utils.AssertEq(tx.Commit(), nil, "commit")
+	update(database, "x", "later")
+	utils.AssertEq(asOf(strconv.FormatUint(tx.ID(), 10), "x"), "back", "x as of after vacuum")
+
+	_, err = c.ExecCommand("begin", []string{"asof", "1000"})
+	utils.Assert(errors.Is(err, mvcc.ErrUnknownTransaction), "begin as of the future")
+	_, err = c.ExecCommand("begin", []string{"asof", "x"})
+	utils.Assert(errors.Is(err, mvcc.ErrUnknownTransaction), "begin as of nonsense")
+
+	// until a transaction ended it isn't known whether its own writes are part of its snapshot, a read as of it would change when it commits.
+	running, err := database.Begin(mvcc.TxOptions{})
+	utils.AssertEq(err, nil, "begin running")
+	utils.AssertEq(running.Set("x", "running"), nil, "running set x")
+	_, err = c.ExecCommand("begin", []string{"asof", strconv.FormatUint(running.ID(), 10)})
+	utils.Assert(errors.Is(err, mvcc.ErrUnknownTransaction), "begin as of a transaction in progress")
+	utils.AssertEq(running.Commit(), nil, "running commit")
+	utils.AssertEq(asOf(strconv.FormatUint(running.ID(), 10), "x"), "running", "x as of once committed")
+
+	_, err = c.ExecCommand("begin", []string{"since", "3"})
+	utils.Assert(errors.Is(err, mvcc.ErrInvalidArguments), "begin since")
+}
+
+func TestHistory(t *testing.T) {
+	t.Parallel()
+
+	var out strings.Builder
+	s := newSession(mvcc.NewDatabase(mvcc.RepeatableReadIsolation), &out)
+	s.run(strings.NewReader(`
+c1 begin
+c1 set x 1
+c1 commit
+c2 begin
+c3 begin
+c3 set x 3
+c3 commit
+c4 begin
+c4 delete x
+c4 set x 4
+c2 history x
+c4 history x
+c4 rollback
+history x
+history y
+c2 delete x
+c2 rollback
+history x
+`))
+
+	// c2 began before c3 committed, it still reads the first version. c4 reads its own.
+	expected := `1
+1
+ok
+2
+3
+3
+ok
+4
+ok
+4
+* start=1 (committed) end=3 (committed) value="1"
+  start=3 (committed) end=4 (in-progress) value="3"
+  start=4 (in-progress) end=- value="4"
+  start=1 (committed) end=3 (committed) value="1"
+  start=3 (committed) end=4 (in-progress) value="3"
+* start=4 (in-progress) end=- value="4"
+ok
+  start=1 (committed) end=3 (committed) value="1"
+  start=3 (committed) end=4 (rolled-back) value="3"
+  start=4 (rolled-back) end=- value="4"
+ok
+ok
+ok
+  start=1 (committed) end=3 (committed), 2 (rolled-back) value="1"
+  start=3 (committed) end=4 (rolled-back) value="3"
+  start=4 (rolled-back) end=- value="4"
+`
+	utils.AssertEq(out.String(), expected, "script output")
+}
+
+// snapshots follow the order in which transactions commit, not the order of their ids.
+func TestCommitTimestamps(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.RepeatableReadIsolation)
+	get := func(tx *mvcc.Tx, key string) string {
+		value, err := tx.Get(key)
+		if errors.Is(err, mvcc.ErrNotFound) {
+			return "<none>"
+		}
+		utils.AssertEq(err, nil, "get "+key)
+		return value
+	}
+
+	t1, _ := database.Begin(mvcc.TxOptions{})
+	t2, _ := database.Begin(mvcc.TxOptions{})
+	utils.AssertEq(t2.Set("x", "2"), nil, "t2 set x")
+	utils.AssertEq(t2.Commit(), nil, "t2 commit")
+
+	// t3 sees t2, which committed before it began, even though t1 with a lower id is still running.
+	t3, _ := database.Begin(mvcc.TxOptions{})
+	utils.AssertEq(get(t3, "x"), "2", "t3 get x")
+
+	utils.AssertEq(t1.Set("y", "1"), nil, "t1 set y")
+	utils.AssertEq(t1.Commit(), nil, "t1 commit")
+	utils.AssertEq(get(t3, "y"), "<none>", "t3 get y after t1 committed")
+	utils.AssertEq(t3.Commit(), nil, "t3 commit")
+
+	t4, _ := database.Begin(mvcc.TxOptions{})
+	utils.AssertEq(get(t4, "x"), "2", "t4 get x")
+	utils.AssertEq(get(t4, "y"), "1", "t4 get y")
+	utils.AssertEq(t4.Commit(), nil, "t4 commit")
+
+	// reading as of t3 sees its snapshot: t2 but not t1.
+	past, err := database.Begin(mvcc.TxOptions{AsOf: t3.ID()})
+	utils.AssertEq(err, nil, "begin as of t3")
+	utils.AssertEq(get(past, "x"), "2", "x as of t3")
+	utils.AssertEq(get(past, "y"), "<none>", "y as of t3")
+	utils.AssertEq(past.Commit(), nil, "commit")
+}
+
+// a hot counter incremented through getforupdate at read committed: every increment waits its turn, none conflicts and none is lost.
+func TestGetForUpdate(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.ReadCommittedIsolation)
+	update(database, "counter", "0")
+
+	const workers = 8
+	const increments = 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c := database.NewConnection()
+			for i := 0; i < increments; i++ {
+				c.MustExecCommand("begin", nil)
+				n, err := strconv.Atoi(c.MustExecCommand("getforupdate", []string{"counter"}))
+				utils.AssertEq(err, nil, "counter is a number")
+				c.MustExecCommand("set", []string{"counter", strconv.Itoa(n + 1)})
+				c.MustExecCommand("commit", nil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	c := database.NewConnection()
+	c.MustExecCommand("begin", nil)
+	utils.AssertEq(c.MustExecCommand("get", []string{"counter"}), strconv.Itoa(workers*increments), "every increment counted")
+	c.MustExecCommand("commit", nil)
+}
+
+func TestGetForUpdateWaits(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.SnapshotIsolation)
+	update(database, "x", "0")
+
+	c1 := database.NewConnection()
+	c1.MustExecCommand("begin", nil)
+	utils.AssertEq(c1.MustExecCommand("getforupdate", []string{"x"}), "0", "c1 getforupdate x")
+
+	// with nowait, the lock is refused right away. Without, the transaction is still usable.
+	c2 := database.NewConnection()
+	c2.MustExecCommand("begin", nil)
+	_, err := c2.ExecCommand("getforupdate", []string{"x", "nowait"})
+	utils.Assert(errors.Is(err, mvcc.ErrLockNotAvailable), "c2 getforupdate x nowait")
+	noWait, _ := database.Begin(mvcc.TxOptions{NoWait: true})
+	utils.Assert(errors.Is(noWait.Set("x", "nowait"), mvcc.ErrLockNotAvailable), "set x with NoWait")
+	noWait.Rollback()
+
+	// a writer waits until the lock holder is done.
+	written := make(chan error)
+	go func() {
+		_, err := c2.ExecCommand("set", []string{"x", "c2"})
+		written <- err
+	}()
+	select {
+	case <-written:
+		panic("set didn't wait for the lock")
+	case <-time.After(20 * time.Millisecond):
+	}
+	c1.MustExecCommand("set", []string{"x", "c1"})
+	c1.MustExecCommand("commit", nil)
+	utils.AssertEq(<-written, nil, "c2 set x after c1 committed")
+
+	// c2's snapshot is older than c1's commit: a locking read in it would read an outdated value, so it is rolled back instead.
+	// the write it did before doesn't matter, and its lock is gone with it.
+	c3 := database.NewConnection()
+	c3.MustExecCommand("begin", nil)
+	_, err = c2.ExecCommand("getforupdate", []string{"x"})
+	utils.Assert(errors.Is(err, mvcc.ErrWriteWriteConflict), "c2 getforupdate x after c1 committed")
+	_, err = c2.ExecCommand("get", []string{"x"})
+	utils.Assert(errors.Is(err, mvcc.ErrNoTransaction), "c2 was rolled back")
+	utils.AssertEq(c3.MustExecCommand("getforupdate", []string{"x", "nowait"}), "c1", "c3 getforupdate x")
+	c3.MustExecCommand("commit", nil)
+
+	_, err = c3.ExecCommand("getforupdate", []string{"x", "now"})
+	utils.Assert(errors.Is(err, mvcc.ErrInvalidArguments), "getforupdate x now")
+}
+
+// plain writes don't hold the lock GetForUpdate takes, so it waits for their transactions instead: two increments of a counter never lose one.
+func TestGetForUpdateWaitsForPlainWrites(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.ReadCommittedIsolation)
+	update(database, "c", "0")
+
+	c1 := database.NewConnection()
+	c1.MustExecCommand("begin", nil)
+	c1.MustExecCommand("set", []string{"c", "1"})
+
+	c2 := database.NewConnection()
+	c2.MustExecCommand("begin", nil)
+	_, err := c2.ExecCommand("getforupdate", []string{"c", "nowait"})
+	utils.Assert(errors.Is(err, mvcc.ErrLockNotAvailable), "c2 getforupdate c nowait")
+
+	read := make(chan string)
+	go func() {
+		read <- c2.MustExecCommand("getforupdate", []string{"c"})
+	}()
+	select {
+	case <-read:
+		panic("getforupdate didn't wait for the uncommitted set")
+	case <-time.After(20 * time.Millisecond):
+	}
+	c1.MustExecCommand("commit", nil)
+	utils.AssertEq(<-read, "1", "c2 getforupdate c after c1 committed")
+	c2.MustExecCommand("set", []string{"c", "2"})
+	c2.MustExecCommand("commit", nil)
+
+	c1.MustExecCommand("begin", nil)
+	utils.AssertEq(c1.MustExecCommand("get", []string{"c"}), "2", "both increments")
+	c1.MustExecCommand("commit", nil)
+
+	// an uncommitted delete counts too, also when a later delete of the same version rolled back.
+	c1.MustExecCommand("begin", nil)
+	c1.MustExecCommand("delete", []string{"c"})
+	c3 := database.NewConnection()
+	c3.MustExecCommand("begin", nil)
+	c3.MustExecCommand("delete", []string{"c"})
+	c3.MustExecCommand("rollback", nil)
+	c2.MustExecCommand("begin", nil)
+	_, err = c2.ExecCommand("getforupdate", []string{"c", "nowait"})
+	utils.Assert(errors.Is(err, mvcc.ErrLockNotAvailable), "c2 getforupdate c nowait after c1 deleted it")
+	c1.MustExecCommand("commit", nil)
+	_, err = c2.ExecCommand("getforupdate", []string{"c"})
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c2 getforupdate c after c1 committed")
+	c2.MustExecCommand("commit", nil)
+}
+
+// under two-phase locking conflicting transactions wait for each other instead of failing at commit. What they read stays locked until they end.
+func TestTwoPhaseLocking(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.TwoPhaseLockingSerializableIsolation)
+	update(database, "x", "0")
+	update(database, "y", "0")
+
+	// waits until done is ready, failing if it already is.
+	blocked := func(done chan error, what string) {
+		select {
+		case <-done:
+			panic(what + " didn't wait for the lock")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	// a reader keeps writers out, readers share.
+	c1 := database.NewConnection()
+	c1.MustExecCommand("begin", nil)
+	utils.AssertEq(c1.MustExecCommand("get", []string{"x"}), "0", "c1 get x")
+	c2 := database.NewConnection()
+	c2.MustExecCommand("begin", nil)
+	utils.AssertEq(c2.MustExecCommand("get", []string{"x"}), "0", "c2 get x")
+
+	written := make(chan error)
+	go func() {
+		_, err := c2.ExecCommand("set", []string{"x", "c2"})
+		written <- err
+	}()
+	blocked(written, "c2 set x")
+	c1.MustExecCommand("commit", nil)
+	utils.AssertEq(<-written, nil, "c2 set x after c1 committed")
+
+	// and a writer keeps readers out. Once it is done they read the latest committed value.
+	c3 := database.NewConnection()
+	c3.MustExecCommand("begin", nil)
+	read := make(chan error)
+	go func() {
+		res, err := c3.ExecCommand("get", []string{"x"})
+		utils.AssertEq(res, "c2", "c3 get x after c2 committed")
+		read <- err
+	}()
+	blocked(read, "c3 get x")
+	c2.MustExecCommand("commit", nil)
+	utils.AssertEq(<-read, nil, "c3 get x after c2 committed")
+	c3.MustExecCommand("commit", nil)
+
+	// write skew: both read x and y, then each writes one of them. Each write waits for the other's shared lock: a deadlock.
+	// the transaction closing the cycle is rolled back right away, the other one goes through.
+	c1.MustExecCommand("begin", nil)
+	c2.MustExecCommand("begin", nil)
+	for _, c := range []*mvcc.Connection{c1, c2} {
+		c.MustExecCommand("get", []string{"x"})
+		c.MustExecCommand("get", []string{"y"})
+	}
+	go func() {
+		_, err := c1.ExecCommand("set", []string{"x", "c1"})
+		written <- err
+	}()
+	blocked(written, "c1 set x")
+	_, err := c2.ExecCommand("set", []string{"y", "c2"})
+	utils.Assert(errors.Is(err, mvcc.ErrDeadlock), "c2 set y deadlocks")
+	utils.Assert(errors.Is(err, mvcc.ErrSerialization), "a deadlock is a serialization failure")
+	var conflict *mvcc.ConflictError
+	utils.Assert(errors.As(err, &conflict), "c2 deadlock is a ConflictError")
+	utils.AssertEq(strings.Join(conflict.Keys, ","), "y", "c2 deadlock keys")
+	_, err = c2.ExecCommand("get", []string{"x"})
+	utils.Assert(errors.Is(err, mvcc.ErrNoTransaction), "c2 was rolled back")
+	utils.AssertEq(<-written, nil, "c1 set x after c2 rolled back")
+	c1.MustExecCommand("commit", nil)
+
+	// phantoms: a scan locks its whole range, keys that don't exist yet included.
+	c1.MustExecCommand("begin", nil)
+	utils.AssertEq(c1.MustExecCommand("prefix", []string{"room1/"}), "", "c1 room1 is free")
+	c2.MustExecCommand("begin", nil)
+	go func() {
+		_, err := c2.ExecCommand("set", []string{"room1/bob", "booked"})
+		written <- err
+	}()
+	blocked(written, "c2 set room1/bob")
+	c1.MustExecCommand("set", []string{"room1/alice", "booked"})
+	c1.MustExecCommand("commit", nil)
+	utils.AssertEq(<-written, nil, "c2 set room1/bob after c1 committed")
+	// c2 never checked, it's only blocked by scans.
+	c2.MustExecCommand("commit", nil)
+
+	// keys outside the range are free.
+	c1.MustExecCommand("begin", nil)
+	c1.MustExecCommand("scan", []string{"room1/", "room1/~"})
+	c2.MustExecCommand("begin", nil)
+	c2.MustExecCommand("set", []string{"room2/bob", "booked"})
+	c2.MustExecCommand("commit", nil)
+	c1.MustExecCommand("commit", nil)
+}
+
+// the same contended workload under the optimistic serializable levels and under two-phase locking: every transaction reads two counters and
+// increments one. All of them are serializable and retried until they commit, so the counters always add up, the levels differ in how many
+// attempts that takes and how they fail.
+func TestPessimisticVersusOptimistic(t *testing.T) {
+	t.Parallel()
+
+	for _, level := range []mvcc.IsolationLevel{
+		mvcc.SerializableIsolation, mvcc.SerializableSnapshotIsolation, mvcc.TwoPhaseLockingSerializableIsolation,
+	} {
+		database := mvcc.NewDatabase(level)
+		update(database, "a", "0")
+		update(database, "b", "0")
+
+		const workers = 6
+		const increments = 20
+
+		var wg sync.WaitGroup
+		var attempts, deadlocks atomic.Int64
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+
+				keys := []string{"a", "b"}
+				if w%2 == 1 {
+					keys = []string{"b", "a"}
+				}
+				for i := 0; i < increments; i++ {
+					n, err := database.RunInTransaction(context.Background(), mvcc.RetryOptions{MaxAttempts: 1000}, func(tx *mvcc.Tx) error {
+						first, err := tx.Get(keys[0])
+						if err != nil {
+							return err
+						}
+						if _, err := tx.Get(keys[1]); err != nil {
+							return err
+						}
+						// long enough for the others to read too.
+						time.Sleep(100 * time.Microsecond)
+						n, _ := strconv.Atoi(first)
+						err = tx.Set(keys[0], strconv.Itoa(n+1))
+						if errors.Is(err, mvcc.ErrDeadlock) {
+							deadlocks.Add(1)
+						}
+						return err
+					})
+					utils.AssertEq(err, nil, level.String()+" increment")
+					attempts.Add(int64(n))
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		tx, _ := database.Begin(mvcc.TxOptions{})
+		a, _ := tx.Get("a")
+		b, _ := tx.Get("b")
+		tx.Commit()
+		utils.AssertEq(a, strconv.Itoa(workers/2*increments), level.String()+" a")
+		utils.AssertEq(b, strconv.Itoa(workers/2*increments), level.String()+" b")
+		if level != mvcc.TwoPhaseLockingSerializableIsolation {
+			utils.AssertEq(deadlocks.Load(), int64(0), level.String()+" never deadlocks")
+		}
+		t.Logf("%v: %d attempts for %d increments, %d deadlocks", level, attempts.Load(), workers*increments, deadlocks.Load())
+	}
+}
+
+// with blocking writes a writer waits for the uncommitted writes of others to the same key instead of racing them to commit.
+func TestBlockingWrites(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.ReadUncommittedIsolation, mvcc.WithBlockingWrites())
+	update(database, "x", "0")
+
+	// even read uncommitted no longer allows dirty writes: c2 can't overwrite x while c1's write of it may still be rolled back.
+	c1, _ := database.Begin(mvcc.TxOptions{})
+	utils.AssertEq(c1.Set("x", "c1"), nil, "c1 set x")
+	c2, _ := database.Begin(mvcc.TxOptions{})
+	written := make(chan error)
+	go func() {
+		written <- c2.Set("x", "c2")
+	}()
+	select {
+	case <-written:
+		panic("c2 set x didn't wait for c1")
+	case <-time.After(20 * time.Millisecond):
+	}
+	utils.AssertEq(database.WaitsFor().String(), fmt.Sprintf("%d -> %d", c2.ID(), c1.ID()), "c2 waits for c1")
+	utils.AssertEq(c1.Rollback(), nil, "c1 rollback")
+	utils.AssertEq(<-written, nil, "c2 set x after c1 rolled back")
+	utils.AssertEq(c2.Commit(), nil, "c2 commit")
+	utils.AssertEq(len(database.WaitsFor()), 0, "nobody waits")
+
+	// an uncommitted delete is waited for too, unless the writer doesn't want to wait.
+	c3, _ := database.Begin(mvcc.TxOptions{})
+	utils.AssertEq(c3.Delete("x"), nil, "c3 delete x")
+	c4, _ := database.Begin(mvcc.TxOptions{NoWait: true})
+	err := c4.Set("x", "c4")
+	utils.Assert(errors.Is(err, mvcc.ErrLockNotAvailable), "c4 set x with NoWait")
+	utils.AssertEq(c4.Set("y", "c4"), nil, "c4 set y")
+	utils.AssertEq(c4.Commit(), nil, "c4 commit")
+	utils.AssertEq(c3.Commit(), nil, "c3 commit")
+}
+
+// transactions waiting on each other's writes deadlock, the detector rolls back one of them as the victim policy says.
+func TestDeadlockDetection(t *testing.T) {
+	t.Parallel()
+
+	// c1 writes x, c2 writes y (and z, twice as much work). Then c1 waits to write y, and c2 to write x: a cycle.
+	// returns the errors of both second writes and the waits-for graph just before the cycle closed.
+	deadlock := func(config mvcc.DeadlockConfig) (*mvcc.Tx, error, *mvcc.Tx, error, string) {
+		database := mvcc.NewDatabase(mvcc.ReadCommittedIsolation, mvcc.WithBlockingWrites(), mvcc.WithDeadlockDetection(config))
+		t.Cleanup(func() { database.Close() })
+
+		c1, _ := database.Begin(mvcc.TxOptions{})
+		c2, _ := database.Begin(mvcc.TxOptions{})
+		utils.AssertEq(c1.Set("x", "c1"), nil, "c1 set x")
+		utils.AssertEq(c2.Set("y", "c2"), nil, "c2 set y")
+		utils.AssertEq(c2.Set("z", "c2"), nil, "c2 set z")
+
+		c1Err := make(chan error)
+		go func() {
+			c1Err <- c1.Set("y", "c1")
+		}()
+		for len(database.WaitsFor()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		graph := database.WaitsFor().String()
+
+		c2Err := make(chan error)
+		go func() {
+			c2Err <- c2.Set("x", "c2")
+		}()
+
+		// the survivor's write goes through once the victim is rolled back.
+		var err1, err2 error
+		select {
+		case err1 = <-c1Err:
+			err2 = <-c2Err
+		case err2 = <-c2Err:
+			err1 = <-c1Err
+		}
+		return c1, err1, c2, err2, graph
+	}
+
+	c1, err1, c2, err2, graph := deadlock(mvcc.DeadlockConfig{})
+	utils.AssertEq(graph, fmt.Sprintf("%d -> %d", c1.ID(), c2.ID()), "c1 waits for c2")
+	utils.AssertEq(err1, nil, "youngest: c1 set y")
+	utils.Assert(errors.Is(err2, mvcc.ErrDeadlock), "youngest: c2 is the victim")
+	var conflict *mvcc.ConflictError
+	utils.Assert(errors.As(err2, &conflict), "deadlock is a ConflictError")
+	utils.AssertEq(conflict.TxId, c2.ID(), "deadlock victim")
+	utils.AssertEq(conflict.OtherTxId, c1.ID(), "the victim waited for c1")
+	utils.Assert(errors.Is(c2.Commit(), mvcc.ErrTransactionDone), "c2 was rolled back")
+	utils.AssertEq(c1.Commit(), nil, "youngest: c1 commit")
+
+	// c1 did less, it is the victim although c2 closed the cycle.
+	c1, err1, c2, err2, _ = deadlock(mvcc.DeadlockConfig{Victim: mvcc.VictimLeastWork})
+	utils.Assert(errors.Is(err1, mvcc.ErrDeadlock), "least work: c1 is the victim")
+	utils.AssertEq(err2, nil, "least work: c2 set x")
+	utils.Assert(errors.Is(c1.Commit(), mvcc.ErrTransactionDone), "c1 was rolled back")
+	utils.AssertEq(c2.Commit(), nil, "least work: c2 commit")
+
+	// the periodic detector finds the cycle after the fact.
+	c1, err1, c2, err2, _ = deadlock(mvcc.DeadlockConfig{Interval: 5 * time.Millisecond})
+	utils.AssertEq(err1, nil, "periodic: c1 set y")
+	utils.Assert(errors.Is(err2, mvcc.ErrDeadlock), "periodic: c2 is the victim")
+	utils.AssertEq(c1.Commit(), nil, "periodic: c1 commit")
+}
+
+// one wait can close two cycles at once: c1 upgrading its shared lock on x waits for both other readers of x, and each of them waits for
+// a lock c1 holds. Rolling back one of them leaves the other cycle, c1 only gets x once both are broken.
+func TestDeadlockDetectionManyCycles(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.TwoPhaseLockingSerializableIsolation)
+	defer database.Close()
+	update(database, "x", "0")
+
+	c1, _ := database.Begin(mvcc.TxOptions{})
+	c2, _ := database.Begin(mvcc.TxOptions{})
+	c3, _ := database.Begin(mvcc.TxOptions{})
+	for _, tx := range []*mvcc.Tx{c1, c2, c3} {
+		_, err := tx.Get("x")
+		utils.AssertEq(err, nil, "get x")
+	}
+	utils.AssertEq(c1.Set("y", "c1"), nil, "c1 set y")
+	utils.AssertEq(c1.Set("z", "c1"), nil, "c1 set z")
+
+	c2Err, c3Err := make(chan error), make(chan error)
+	go func() {
+		c2Err <- c2.Set("y", "c2")
+	}()
+	go func() {
+		c3Err <- c3.Set("z", "c3")
+	}()
+	for len(database.WaitsFor()) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	utils.AssertEq(c1.Set("x", "c1"), nil, "c1 set x")
+	utils.Assert(errors.Is(<-c2Err, mvcc.ErrDeadlock), "c2 is a victim")
+	utils.Assert(errors.Is(<-c3Err, mvcc.ErrDeadlock), "c3 is a victim")
+	utils.AssertEq(c1.Commit(), nil, "c1 commit")
+}
+
+func TestTimeouts(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.ReadCommittedIsolation)
+	update(database, "x", "0")
+
+	holder, _ := database.Begin(mvcc.TxOptions{})
+	_, err := holder.GetForUpdate("x", false)
+	utils.AssertEq(err, nil, "holder getforupdate x")
+
+	// a context bounds the wait for the lock. The transaction keeps going and isn't left waiting.
+	tx, _ := database.Begin(mvcc.TxOptions{})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	_, err = tx.GetForUpdateContext(ctx, "x", false)
+	cancel()
+	utils.Assert(errors.Is(err, context.DeadlineExceeded), "getforupdate x gives up with the context")
+	utils.AssertEq(len(database.WaitsFor()), 0, "nobody waits")
+	utils.AssertEq(tx.Set("y", "tx"), nil, "tx keeps going")
+
+	// a done context fails right away, through a connection too.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	utils.Assert(errors.Is(tx.SetContext(ctx, "z", "tx"), context.Canceled), "set z with a canceled context")
+	c := database.NewConnection()
+	c.MustExecCommand("begin", nil)
+	_, err = c.ExecCommandContext(ctx, "get", []string{"x"})
+	utils.Assert(errors.Is(err, context.Canceled), "get x with a canceled context")
+	c.MustExecCommand("commit", nil)
+	_, err = c.ExecCommandContext(ctx, "begin", nil)
+	utils.Assert(errors.Is(err, context.Canceled), "begin with a canceled context")
+	_, err = database.BeginContext(ctx, mvcc.TxOptions{})
+	utils.Assert(errors.Is(err, context.Canceled), "BeginContext with a canceled context")
+
+	// so do the calls that never wait, the transaction is left as it was.
+	utils.Assert(errors.Is(tx.SavepointContext(ctx, "sp"), context.Canceled), "savepoint with a canceled context")
+	utils.Assert(errors.Is(tx.CommitContext(ctx), context.Canceled), "commit with a canceled context")
+	utils.AssertEq(tx.Commit(), nil, "tx commit")
+
+	// the statement timeout applies to every call on its own.
+	tx, _ = database.Begin(mvcc.TxOptions{StatementTimeout: 20 * time.Millisecond})
+	err = tx.Set("x", "tx")
+	utils.Assert(errors.Is(err, mvcc.ErrStatementTimeout), "set x times out")
+	utils.Assert(errors.Is(err, context.DeadlineExceeded), "a statement timeout is a deadline")
+	utils.AssertEq(holder.Commit(), nil, "holder commit")
+	utils.AssertEq(tx.Set("x", "tx"), nil, "set x once the lock is free")
+	utils.AssertEq(tx.Commit(), nil, "tx commit")
+
+	// a transaction making calls doesn't time out however long it runs, only one left idle does.
+	idle, _ := database.Begin(mvcc.TxOptions{IdleTimeout: 50 * time.Millisecond})
+	for i := 0; i < 5; i++ {
+		_, err := idle.GetForUpdate("x", false)
+		utils.AssertEq(err, nil, "busy getforupdate x")
+		time.Sleep(20 * time.Millisecond)
+	}
+	utils.AssertEq(idle.Set("x", "idle"), nil, "idle set x")
+	time.Sleep(150 * time.Millisecond)
+
+	// it was rolled back: its write is gone, so is its lock, and it no longer holds back vacuum.
+	_, err = idle.Get("x")
+	utils.Assert(errors.Is(err, mvcc.ErrIdleInTransactionTimeout), "idle transaction timed out")
+	utils.Assert(errors.Is(idle.Commit(), mvcc.ErrIdleInTransactionTimeout), "idle transaction can't commit")
+	tx, _ = database.Begin(mvcc.TxOptions{NoWait: true})
+	res, err := tx.GetForUpdate("x", false)
+	utils.AssertEq(err, nil, "getforupdate x after the idle transaction timed out")
+	utils.AssertEq(res, "tx", "the idle transaction's write was rolled back")
+	utils.AssertEq(tx.Commit(), nil, "tx commit")
+	utils.AssertEq(database.Vacuum().Horizon, tx.ID()+1, "vacuum horizon")
+}
+
+// first-committer-wins lets a doomed transaction keep working until commit, first-updater-wins stops it at the write.
+func TestFirstUpdaterWins(t *testing.T) {
+	t.Parallel()
+
+	// c1 writes x, then c2 writes x and goes on to do more work. Returns the error of c2's write of x and of its commit,
+	// after c1 finished with commit or rollback.
+	race := func(policy mvcc.WriteConflictPolicy, c1Commits bool) (error, error) {
+		database := mvcc.NewDatabase(mvcc.SnapshotIsolation, mvcc.WithWriteConflicts(policy))
+		update(database, "x", "0")
+
+		c1 := database.NewConnection()
+		c1.MustExecCommand("begin", nil)
+		c2 := database.NewConnection()
+		c2.MustExecCommand("begin", nil)
+		c1.MustExecCommand("set", []string{"x", "c1"})
+
+		written := make(chan error)
+		go func() {
+			_, err := c2.ExecCommand("set", []string{"x", "c2"})
+			written <- err
+		}()
+
+		var setErr error
+		waited := false
+		select {
+		case setErr = <-written:
+		case <-time.After(20 * time.Millisecond):
+			waited = true
+		}
+		if c1Commits {
+			c1.MustExecCommand("commit", nil)
+		} else {
+			c1.MustExecCommand("rollback", nil)
+		}
+		if waited {
+			setErr = <-written
+		}
+		if setErr != nil {
+			return setErr, nil
+		}
+
+		c2.MustExecCommand("set", []string{"y", "c2"})
+		_, err := c2.ExecCommand("commit", nil)
+		return nil, err
+	}
+
+	// the loser only finds out at commit, after all its work.
+	setErr, commitErr := race(mvcc.FirstCommitterWins, true)
+	utils.AssertEq(setErr, nil, "first committer wins: c2 set x")
+	utils.Assert(errors.Is(commitErr, mvcc.ErrWriteWriteConflict), "first committer wins: c2 commit")
+
+	// the loser fails at the write, while c1 is still in progress.
+	setErr, _ = race(mvcc.FirstUpdaterWinsFail, true)
+	utils.Assert(errors.Is(setErr, mvcc.ErrWriteWriteConflict), "first updater wins, fail: c2 set x")
+	// even if c1 rolls back in the end.
+	setErr, _ = race(mvcc.FirstUpdaterWinsFail, false)
+	utils.Assert(errors.Is(setErr, mvcc.ErrWriteWriteConflict), "first updater wins, fail: c2 set x, c1 rolled back")
+
+	// the loser waits for c1 and only fails if c1 commits.
+	setErr, _ = race(mvcc.FirstUpdaterWinsWait, true)
+	utils.Assert(errors.Is(setErr, mvcc.ErrWriteWriteConflict), "first updater wins, wait: c2 set x")
+	setErr, commitErr = race(mvcc.FirstUpdaterWinsWait, false)
+	utils.AssertEq(setErr, nil, "first updater wins, wait: c2 set x, c1 rolled back")
+	utils.AssertEq(commitErr, nil, "first updater wins, wait: c2 commit, c1 rolled back")
+
+	// a write committed after the snapshot conflicts just the same, and the failed write rolled the transaction back.
+	database := mvcc.NewDatabase(mvcc.SnapshotIsolation, mvcc.WithWriteConflicts(mvcc.FirstUpdaterWinsFail))
+	c1 := database.NewConnection()
+	c1.MustExecCommand("begin", nil)
+	update(database, "x", "committed")
+	_, err := c1.ExecCommand("delete", []string{"x"})
+	var conflict *mvcc.ConflictError
+	utils.Assert(errors.As(err, &conflict), "c1 delete x is a ConflictError")
+	utils.AssertEq(strings.Join(conflict.Keys, ","), "x", "conflict keys")
+	_, err = c1.ExecCommand("get", []string{"x"})
+	utils.Assert(errors.Is(err, mvcc.ErrNoTransaction), "c1 was rolled back")
+
+	// read committed doesn't forbid write-write conflicts, the policy doesn't apply to it.
+	c1.MustExecCommand("begin", []string{"read-committed"})
+	c2 := database.NewConnection()
+	c2.MustExecCommand("begin", []string{"read-committed"})
+	c1.MustExecCommand("set", []string{"x", "c1"})
+	c2.MustExecCommand("set", []string{"x", "c2"})
+	c1.MustExecCommand("commit", nil)
+	c2.MustExecCommand("commit", nil)
+
+	// a committed delete is found even when a later transaction ended the version too and rolled back.
+	si := database.NewConnection()
+	si.MustExecCommand("begin", nil)
+	rr := database.NewConnection()
+	rr.MustExecCommand("begin", []string{"repeatable-read"})
+	c1.MustExecCommand("begin", []string{"read-committed"})
+	c1.MustExecCommand("delete", []string{"x"})
+	c1.MustExecCommand("commit", nil)
+	rr.MustExecCommand("delete", []string{"x"})
+	rr.MustExecCommand("rollback", nil)
+	_, err = si.ExecCommand("set", []string{"x", "si"})
+	utils.Assert(errors.Is(err, mvcc.ErrWriteWriteConflict), "si set x after a committed delete")
+}
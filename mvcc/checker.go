@@ -0,0 +1,386 @@
+package mvcc
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// the checker looks for anomalies in a recorded history, like Jepsen's Elle: it infers which transaction depends on which from what the
+// clients read and wrote, and looks for cycles in that dependency graph. Every kind of cycle is one of Adya's phenomena, every isolation level
+// proscribes some of them. See "Elle: Inferring Isolation Anomalies from Experimental Observations" and https://jepsen.io/consistency.
+//
+// inferring the dependencies needs a workload whose values tell their own history. The checker understands list-append, Elle's favorite:
+// every key holds a comma separated list, and every write of a key (set) writes the list the transaction read from it (get) plus one new
+// element, unique over the whole history. A list then names every write before it, in order. The longest list written by a committed
+// transaction is the version order of the key, every committed version is a prefix of it. A committed write that isn't was lost.
+//
+// edges between committed transactions:
+//   - ww: T1 wrote a version of a key, T2 wrote the next one.
+//   - wr: T2 read a version T1 wrote.
+//   - rw: T1 read a version of a key, T2 wrote the next one (an anti-dependency).
+
+type AnomalyKind uint8
+
+const (
+	// a cycle of ww edges: writes of two transactions interleave.
+	AnomalyG0 AnomalyKind = iota
+	// a committed transaction read a write of a transaction that rolled back.
+	AnomalyG1a
+	// a committed transaction read a version its writer overwrote itself later on.
+	AnomalyG1b
+	// a cycle of ww and wr edges: transactions saw each other's writes both ways.
+	AnomalyG1c
+	// a cycle with exactly one rw edge, like read skew.
+	AnomalyGSingle
+	// a cycle with more than one rw edge, like write skew.
+	AnomalyG2
+	// a committed write isn't in the version order: another transaction overwrote it without having read it.
+	AnomalyLostUpdate
+)
+
+func (k AnomalyKind) String() string {
+	switch k {
+	case AnomalyG0:
+		return "G0"
+	case AnomalyG1a:
+		return "G1a"
+	case AnomalyG1b:
+		return "G1b"
+	case AnomalyG1c:
+		return "G1c"
+	case AnomalyGSingle:
+		return "G-single"
+	case AnomalyG2:
+		return "G2"
+	case AnomalyLostUpdate:
+		return "lost-update"
+	}
+	return fmt.Sprintf("AnomalyKind(%d)", uint8(k))
+}
+
+// the anomalies every level rules out. Mostly Adya's, except where this database is weaker than the standard levels, like the anomaly
+// suite shows: writes up to repeatable read never wait for or fail on other writes, so G0 and lost updates are only proscribed from snapshot
+// isolation on. In a list-append history a dirty write shows up as a lost update, not as a G0 cycle.
+var proscribedAnomalies = map[IsolationLevel][]AnomalyKind{
+	ReadUncommittedIsolation:             {},
+	ReadCommittedIsolation:               {AnomalyG1a, AnomalyG1b, AnomalyG1c},
+	RepeatableReadIsolation:              {AnomalyG1a, AnomalyG1b, AnomalyG1c, AnomalyGSingle},
+	SnapshotIsolation:                    {AnomalyG0, AnomalyG1a, AnomalyG1b, AnomalyG1c, AnomalyGSingle, AnomalyLostUpdate},
+	SerializableIsolation:                {AnomalyG0, AnomalyG1a, AnomalyG1b, AnomalyG1c, AnomalyGSingle, AnomalyG2, AnomalyLostUpdate},
+	SerializableSnapshotIsolation:        {AnomalyG0, AnomalyG1a, AnomalyG1b, AnomalyG1c, AnomalyGSingle, AnomalyG2, AnomalyLostUpdate},
+	TwoPhaseLockingSerializableIsolation: {AnomalyG0, AnomalyG1a, AnomalyG1b, AnomalyG1c, AnomalyGSingle, AnomalyG2, AnomalyLostUpdate},
+}
+
+type Anomaly struct {
+	Kind AnomalyKind
+	// the transactions involved: the cycle, in order, or the reader and the writer it shouldn't have read from, or the writer whose write was lost.
+	Txs []uint64
+	// a human readable account, e.g. "3 -rw(x)-> 5 -ww(y)-> 3".
+	Explanation string
+}
+
+func (a Anomaly) String() string {
+	return fmt.Sprintf("%v: %s", a.Kind, a.Explanation)
+}
+
+// CheckHistory returns the anomalies in events that transactions at level must never show, see FindAnomalies.
+func CheckHistory(events []Event, level IsolationLevel) []Anomaly {
+	var found []Anomaly
+	for _, a := range FindAnomalies(events) {
+		if slices.Contains(proscribedAnomalies[level], a.Kind) {
+			found = append(found, a)
+		}
+	}
+	return found
+}
+
+type edgeKind uint8
+
+const (
+	wwEdge edgeKind = 1 << iota
+	wrEdge
+	rwEdge
+)
+
+// what a transaction did, gathered from the history.
+type historyTx struct {
+	id        uint64
+	committed bool
+	// the values read and written, by key, in order.
+	reads  map[string][]string
+	writes map[string][]string
+}
+
+// an element of a list, and the write that appended it.
+type appendWrite struct {
+	tx *historyTx
+	// whether it was the transaction's last write of the key.
+	final bool
+}
+
+// FindAnomalies returns every anomaly in a list-append history, each cycle once. Transactions that didn't commit only matter when someone read
+// their writes.
+func FindAnomalies(events []Event) []Anomaly {
+	txs := map[uint64]*historyTx{}
+	tx := func(id uint64) *historyTx {
+		if _, ok := txs[id]; !ok {
+			txs[id] = &historyTx{id: id, reads: map[string][]string{}, writes: map[string][]string{}}
+		}
+		return txs[id]
+	}
+	for _, e := range events {
+		if e.TxId == 0 {
+			continue
+		}
+		switch {
+		case e.Type == OkEvent && e.Command == "get":
+			tx(e.TxId).reads[e.Args[0]] = append(tx(e.TxId).reads[e.Args[0]], e.Result)
+		// a key that doesn't exist yet is the empty list.
+		case e.Type == FailEvent && e.Command == "get" && errors.Is(e.Err, ErrNotFound):
+			tx(e.TxId).reads[e.Args[0]] = append(tx(e.TxId).reads[e.Args[0]], "")
+		case e.Type == OkEvent && e.Command == "set":
+			tx(e.TxId).writes[e.Args[0]] = append(tx(e.TxId).writes[e.Args[0]], e.Args[1])
+		case e.Type == OkEvent && e.Command == "commit":
+			tx(e.TxId).committed = true
+		}
+	}
+
+	ids := make([]uint64, 0, len(txs))
+	for id := range txs {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	var anomalies []Anomaly
+
+	// who appended every element, and the version order of every key.
+	writers := map[string]map[string]appendWrite{}
+	order := map[string][]string{}
+	for _, id := range ids {
+		t := txs[id]
+		for key, values := range t.writes {
+			if writers[key] == nil {
+				writers[key] = map[string]appendWrite{}
+			}
+			for i, value := range values {
+				elements := splitList(value)
+				writers[key][elements[len(elements)-1]] = appendWrite{tx: t, final: i == len(values)-1}
+				if t.committed && len(elements) > len(order[key]) {
+					order[key] = elements
+				}
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(order))
+	for key := range order {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, id := range ids {
+		t := txs[id]
+		if !t.committed {
+			continue
+		}
+		for _, key := range sortedKeys(t.writes) {
+			for _, value := range t.writes[key] {
+				if !isPrefix(splitList(value), order[key]) {
+					anomalies = append(anomalies, Anomaly{
+						Kind:        AnomalyLostUpdate,
+						Txs:         []uint64{id},
+						Explanation: fmt.Sprintf("%d wrote %s=[%s], but the longest committed version is [%s]", id, key, value, strings.Join(order[key], ",")),
+					})
+				}
+			}
+		}
+	}
+
+	// the dependency graph between committed transactions.
+	graph := map[uint64]map[uint64]edgeKind{}
+	labels := map[[2]uint64]string{}
+	addEdge := func(from *historyTx, to *historyTx, kind edgeKind, key string) {
+		if from == nil || to == nil || from == to || !from.committed || !to.committed {
+			return
+		}
+		if graph[from.id] == nil {
+			graph[from.id] = map[uint64]edgeKind{}
+		}
+		if graph[from.id][to.id]&kind == 0 {
+			graph[from.id][to.id] |= kind
+			label := fmt.Sprintf("%s(%s)", kind, key)
+			if existing := labels[[2]uint64{from.id, to.id}]; existing != "" {
+				label = existing + "," + label
+			}
+			labels[[2]uint64{from.id, to.id}] = label
+		}
+	}
+	writerOf := func(key string, element string) *historyTx {
+		return writers[key][element].tx
+	}
+
+	for _, key := range keys {
+		for i := 1; i < len(order[key]); i++ {
+			addEdge(writerOf(key, order[key][i-1]), writerOf(key, order[key][i]), wwEdge, key)
+		}
+	}
+
+	for _, id := range ids {
+		t := txs[id]
+		if !t.committed {
+			continue
+		}
+		for _, key := range sortedKeys(t.reads) {
+			for _, value := range t.reads[key] {
+				elements := splitList(value)
+
+				// the version read: who wrote it, and who wrote the one after it.
+				var writer *historyTx
+				if len(elements) > 0 {
+					w, ok := writers[key][elements[len(elements)-1]]
+					if !ok {
+						continue
+					}
+					writer = w.tx
+					if writer != t {
+						// the elements before the last one were read from the versions they were appended to, those writers count too.
+						for _, element := range elements {
+							if w := writers[key][element]; w.tx != nil && !w.tx.committed && w.tx != t {
+								anomalies = append(anomalies, Anomaly{
+									Kind:        AnomalyG1a,
+									Txs:         []uint64{id, w.tx.id},
+									Explanation: fmt.Sprintf("%d read %s=[%s], with element %s of %d which didn't commit", id, key, value, element, w.tx.id),
+								})
+								break
+							}
+						}
+						if !w.final && w.tx.committed {
+							anomalies = append(anomalies, Anomaly{
+								Kind:        AnomalyG1b,
+								Txs:         []uint64{id, writer.id},
+								Explanation: fmt.Sprintf("%d read %s=[%s], an intermediate version of %d", id, key, value, writer.id),
+							})
+						}
+					}
+				}
+				addEdge(writer, t, wrEdge, key)
+
+				if isPrefix(elements, order[key]) && len(elements) < len(order[key]) {
+					addEdge(t, writerOf(key, order[key][len(elements)]), rwEdge, key)
+				}
+			}
+		}
+	}
+
+	// every cycle is found starting from each of its edges, keep one of each.
+	seen := map[string]bool{}
+	cycle := func(kind AnomalyKind, from uint64, to uint64, allowed edgeKind) {
+		path := shortestPath(graph, to, from, allowed)
+		if path == nil {
+			return
+		}
+		path = append([]uint64{from}, path...)
+
+		members := slices.Clone(path[:len(path)-1])
+		slices.Sort(members)
+		id := fmt.Sprint(members)
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+
+		parts := []string{fmt.Sprint(path[0])}
+		for i := 1; i < len(path); i++ {
+			parts = append(parts, fmt.Sprintf("-%s->", labels[[2]uint64{path[i-1], path[i]}]), fmt.Sprint(path[i]))
+		}
+		anomalies = append(anomalies, Anomaly{Kind: kind, Txs: path[:len(path)-1], Explanation: strings.Join(parts, " ")})
+	}
+
+	// the weakest explanation of a cycle first: a cycle of ww edges only is G0 even though it is G1c and G2 as well.
+	edges := func(kind edgeKind, visit func(from uint64, to uint64)) {
+		for _, from := range ids {
+			tos := make([]uint64, 0, len(graph[from]))
+			for to, kinds := range graph[from] {
+				if kinds&kind != 0 {
+					tos = append(tos, to)
+				}
+			}
+			slices.Sort(tos)
+			for _, to := range tos {
+				visit(from, to)
+			}
+		}
+	}
+	edges(wwEdge, func(from uint64, to uint64) { cycle(AnomalyG0, from, to, wwEdge) })
+	edges(wwEdge|wrEdge, func(from uint64, to uint64) { cycle(AnomalyG1c, from, to, wwEdge|wrEdge) })
+	edges(rwEdge, func(from uint64, to uint64) { cycle(AnomalyGSingle, from, to, wwEdge|wrEdge) })
+	edges(rwEdge, func(from uint64, to uint64) { cycle(AnomalyG2, from, to, wwEdge|wrEdge|rwEdge) })
+
+	return anomalies
+}
+
+func (k edgeKind) String() string {
+	switch k {
+	case wwEdge:
+		return "ww"
+	case wrEdge:
+		return "wr"
+	case rwEdge:
+		return "rw"
+	}
+	return fmt.Sprintf("edgeKind(%d)", uint8(k))
+}
+
+// the shortest path from one transaction to another using only allowed edges, both ends included. Nil if there is none.
+func shortestPath(graph map[uint64]map[uint64]edgeKind, from uint64, to uint64, allowed edgeKind) []uint64 {
+	previous := map[uint64]uint64{from: from}
+	queue := []uint64{from}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if id == to {
+			path := []uint64{to}
+			for id != from {
+				id = previous[id]
+				path = append(path, id)
+			}
+			slices.Reverse(path)
+			return path
+		}
+
+		next := make([]uint64, 0, len(graph[id]))
+		for n, kinds := range graph[id] {
+			if _, ok := previous[n]; !ok && kinds&allowed != 0 {
+				next = append(next, n)
+			}
+		}
+		slices.Sort(next)
+		for _, n := range next {
+			previous[n] = id
+			queue = append(queue, n)
+		}
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func isPrefix(prefix []string, list []string) bool {
+	return len(prefix) <= len(list) && slices.Equal(prefix, list[:len(prefix)])
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
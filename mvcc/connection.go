@@ -1,110 +1,242 @@
 package mvcc
 
 import (
+	"context"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/mukeshjc/mvcc-isolation/v2/utils"
 )
 
 // final bit of scaffolding we'll set up is an abstraction for database connections. A connection will have at most associated one transaction.
 // users must ask the database for a new connection. Then within the connection they can manage a transaction.
+// a Connection is not safe for concurrent use; goroutines that want to talk to the same database concurrently should each open their own.
+//
+// the connection only translates string commands to the Tx API, which Go code can also use directly.
 type Connection struct {
-	tx *Transaction
+	tx *Tx
 	db *Database
+
+	// the connection's number in the history, if the database records one.
+	process int
+}
+
+// the arguments every command takes. Anything else is rejected before it gets near the database.
+var commandArgs = map[string]struct {
+	min, max int
+	usage    string
+}{
+	"begin":    {0, 2, "begin [isolation level | asof id]"},
+	"commit":   {0, 0, "commit"},
+	"rollback": {0, 2, "rollback [to savepoint]"},
+	"get":      {1, 1, "get key"},
+	"set":      {2, 2, "set key value"},
+	"delete":   {1, 1, "delete key"},
+	"scan":     {1, 2, "scan start [end]"},
+	"prefix":   {1, 1, "prefix p"},
+
+	"getforupdate": {1, 2, "getforupdate key [nowait]"},
+	"savepoint":    {1, 1, "savepoint name"},
+	"release":      {1, 1, "release name"},
+
+	// works outside of a transaction too, then no version is marked visible.
+	"history": {1, 1, "history key"},
+}
+
+// validate checks the command and its arguments, and that the connection is in a state to run it.
+// misuse is returned as an error, it must never panic: one misbehaving client can't take down every other connection of the process.
+func (c *Connection) validate(command string, args []string) error {
+	spec, ok := commandArgs[command]
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrUnknownCommand, command)
+	}
+	if len(args) < spec.min || len(args) > spec.max {
+		return &ArgumentError{Command: command, Usage: spec.usage, Got: len(args)}
+	}
+	if command == "begin" && len(args) == 2 && args[0] != "asof" {
+		return &ArgumentError{Command: command, Usage: spec.usage, Got: len(args)}
+	}
+	if command == "getforupdate" && len(args) == 2 && args[1] != "nowait" {
+		return &ArgumentError{Command: command, Usage: spec.usage, Got: len(args)}
+	}
+	// "rollback" alone rolls back the whole transaction, "rollback to name" only back to a savepoint.
+	if command == "rollback" && len(args) > 0 && (len(args) != 2 || args[0] != "to") {
+		return &ArgumentError{Command: command, Usage: spec.usage, Got: len(args)}
+	}
+
+	if command == "begin" && c.tx != nil {
+		return ErrTransactionInProgress
+	}
+	if command != "begin" && command != "history" && c.tx == nil {
+		return ErrNoTransaction
+	}
+	return nil
 }
 
 func (c *Connection) ExecCommand(command string, args []string) (string, error) {
-	utils.Debug(command, args)
+	return c.ExecCommandContext(context.Background(), command, args)
+}
 
-	// neat thing about MVCC is that beginning, committing, and rollingback a transaction is metadata work.
-	// it will not involve modifying any values we get, set, or delete.
+// ExecCommandContext is ExecCommand giving up on waiting for other transactions once ctx is done, and not starting a command at all when it
+// is done already, see Tx.
+func (c *Connection) ExecCommandContext(ctx context.Context, command string, args []string) (string, error) {
+	if c.db.recorder == nil {
+		return c.exec(ctx, command, args)
+	}
 
-	// begin a transaction, we ask the database for a new transaction and assign it to the current connection.
-	if command == "begin" {
-		utils.AssertEq(c.tx, nil, "no running transactions")
-		c.tx = c.db.newTransaction()
-		c.db.assertValidTransaction(c.tx)
-		return fmt.Sprintf("%d", c.tx.id), nil
-	}
-
-	// rolback/commit a transaction, we call the completeTransaction method (which makes sure the database transaction history gets updated)
-	// with the RolledBackTransaction/CommittedTransaction state.
-	if command == "rollback" {
-		c.db.assertValidTransaction(c.tx)
-		err := c.db.completeTransaction(c.tx, RolledBackTransaction)
-		c.tx = nil
-		return "", err
+	// the transaction is gone once the command ended it, and only there once begin returns.
+	var txId uint64
+	if c.tx != nil && command != "begin" {
+		txId = c.tx.ID()
+	}
+	c.db.recorder.record(Event{Type: InvokeEvent, Process: c.process, TxId: txId, Command: command, Args: args})
+
+	res, err := c.exec(ctx, command, args)
+	if txId == 0 && c.tx != nil {
+		txId = c.tx.ID()
 	}
+	e := Event{Type: OkEvent, Process: c.process, TxId: txId, Command: command, Args: args, Result: res}
+	if err != nil {
+		e.Type, e.Err = FailEvent, err
+	}
+	c.db.recorder.record(e)
+	return res, err
+}
 
-	if command == "commit" {
-		c.db.assertValidTransaction(c.tx)
-		err := c.db.completeTransaction(c.tx, CommittedTransaction)
+func (c *Connection) exec(ctx context.Context, command string, args []string) (string, error) {
+	utils.Debug(command, args)
+
+	// a transaction that timed out while idle doesn't keep the connection from beginning the next one.
+	// any other command still runs into it, and reports why it ended.
+	if command == "begin" && c.tx != nil && c.tx.finished() {
 		c.tx = nil
+	}
+
+	if err := c.validate(command, args); err != nil {
 		return "", err
 	}
 
-	// "get" support, we'll iterate the list of value versions backwards for the key. And we'll call a special "isvisible" method to determine if this transaction can see this value.
-	// The first value that passes the isvisible test is the correct value for the transaction.
-	if command == "get" {
-		c.db.assertValidTransaction(c.tx)
+	// whatever ended the transaction (commit, rollback, or a failure that rolled it back) frees the connection for the next one.
+	defer func() {
+		if c.tx != nil && c.tx.finished() {
+			c.tx = nil
+		}
+	}()
 
-		key := args[0]
+	switch command {
+	// begin a transaction, we ask the database for a new transaction and assign it to the current connection.
+	// the isolation level is the database default, unless one is given by name (see ParseIsolationLevel).
+	// "begin asof id" starts a read-only transaction reading the database as of a past transaction instead (see TxOptions.AsOf).
+	case "begin":
+		var opts TxOptions
+		switch {
+		case len(args) == 2:
+			asOf, err := strconv.ParseUint(args[1], 10, 64)
+			if err != nil || asOf == 0 {
+				return "", fmt.Errorf("%w %q", ErrUnknownTransaction, args[1])
+			}
+			opts.AsOf = asOf
+		case len(args) == 1:
+			level, err := ParseIsolationLevel(args[0])
+			if err != nil {
+				return "", err
+			}
+			opts.Isolation = &level
+		}
 
-		// useful for stricter isolation levels
-		c.tx.readset.Insert(key)
+		id, err := c.begin(ctx, opts)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d", id), nil
 
-		for i := len(c.db.store[key]) - 1; i > -1; i-- {
-			value := c.db.store[key][i]
-			utils.Debug(value, c.tx, c.db.isVisible(c.tx, value))
-			if c.db.isVisible(c.tx, value) {
-				return value.value, nil
+	case "rollback":
+		if len(args) > 0 {
+			return "", c.tx.RollbackToContext(ctx, args[1])
+		}
+		return "", c.tx.Rollback()
+
+	case "commit":
+		return "", c.tx.CommitContext(ctx)
+
+	case "get":
+		return c.tx.GetContext(ctx, args[0])
+
+	// "getforupdate key [nowait]" locks key until the transaction ends, see Tx.GetForUpdate.
+	case "getforupdate":
+		return c.tx.GetForUpdateContext(ctx, args[0], len(args) > 1)
+
+	// "scan start [end]" and "prefix p" return one "key=value" per line.
+	case "scan", "prefix":
+		var kvs []KeyValue
+		var err error
+		if command == "scan" {
+			end := ""
+			if len(args) > 1 {
+				end = args[1]
 			}
+			kvs, err = c.tx.ScanContext(ctx, args[0], end)
+		} else {
+			kvs, err = c.tx.PrefixContext(ctx, args[0])
+		}
+		if err != nil {
+			return "", err
 		}
 
-		return "", fmt.Errorf("cannot get key that doesn't exist")
-	}
+		lines := make([]string, len(kvs))
+		for i, kv := range kvs {
+			lines[i] = kv.Key + "=" + kv.Value
+		}
+		return strings.Join(lines, "\n"), nil
 
-	// set and delete are similar to get. But this time when we walk the list of value versions, we will set the txEndId for the value to the current transaction id if the value version is visible to this transaction.
-	if command == "set" || command == "delete" {
-		c.db.assertValidTransaction(c.tx)
+	// set returns the value it set.
+	case "set":
+		if err := c.tx.SetContext(ctx, args[0], args[1]); err != nil {
+			return "", err
+		}
+		return args[1], nil
 
-		key := args[0]
+	case "delete":
+		return "", c.tx.DeleteContext(ctx, args[0])
 
-		// mark all visible versions as now invalid
-		found := false
-		for i := len(c.db.store[key]) - 1; i > -1; i-- {
-			value := &c.db.store[key][i]
-			utils.Debug(value, c.tx, c.db.isVisible(c.tx, *value))
-			if c.db.isVisible(c.tx, *value) {
-				value.txEndId = c.tx.id
-				found = true
-			}
+	// "history key" prints every version of key, the one the transaction reads marked with a "*".
+	case "history":
+		if c.tx == nil {
+			return FormatHistory(c.db.History(args[0])), nil
 		}
-
-		if command == "delete" && !found {
-			return "", fmt.Errorf("cannot delete key that doesn't exist")
+		versions, err := c.tx.HistoryContext(ctx, args[0])
+		if err != nil {
+			return "", err
 		}
+		return FormatHistory(versions), nil
 
-		// useful for stricter isolation levels
-		c.tx.writeset.Insert(key)
+	case "savepoint":
+		return "", c.tx.SavepointContext(ctx, args[0])
 
-		// for set, we'll append to the value version list with the new version of the value that starts at this current transaction.
-		if command == "set" {
-			value := args[1]
-			c.db.store[key] = append(c.db.store[key], Value{
-				txStartId: c.tx.id,
-				txEndId:   0,
-				value:     value,
-			})
+	case "release":
+		return "", c.tx.ReleaseContext(ctx, args[0])
+	}
 
-			return value, nil
-		}
+	panic(fmt.Sprintf("%v command validated but not handled", command))
+}
 
-		// delete ok.
-		return "", nil
+// Begin starts a transaction at the given isolation level on the connection and returns its id.
+func (c *Connection) Begin(isolation IsolationLevel) (uint64, error) {
+	return c.begin(context.Background(), TxOptions{Isolation: &isolation})
+}
+
+func (c *Connection) begin(ctx context.Context, opts TxOptions) (uint64, error) {
+	if c.tx != nil {
+		return 0, ErrTransactionInProgress
 	}
 
-	return "", fmt.Errorf("%v command unimplemented", command)
+	tx, err := c.db.BeginContext(ctx, opts)
+	if err != nil {
+		return 0, err
+	}
+	c.tx = tx
+	return tx.ID(), nil
 }
 
 func (c *Connection) MustExecCommand(cmd string, args []string) string {
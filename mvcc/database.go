@@ -2,6 +2,9 @@ package mvcc
 
 import (
 	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
 
 	"github.com/tidwall/btree"
 
@@ -9,37 +12,228 @@ import (
 )
 
 type Database struct {
-	defaultIsolation  IsolationLevel
-	store             map[string][]Value
+	defaultIsolation IsolationLevel
+
+	// storeMu only guards the mapping of keys to their version chains. The versions themselves are guarded by the lock of each chain.
+	// keys are kept in order so that ranges of them can be scanned.
+	storeMu sync.RWMutex
+	store   btree.Map[string, *versionChain]
+
+	// txMu guards the transaction history, the id counter and the commit timestamps.
+	txMu              sync.RWMutex
 	transactions      btree.Map[uint64, Transaction]
 	nextTransactionId uint64
+	// the commit timestamp of the last commit, and the id of the transaction that committed at every timestamp. See Transaction.startTs.
+	lastCommitTs uint64
+	commits      btree.Map[uint64, uint64]
+
+	// nil unless the database was opened WithWAL.
+	wal *wal
+
+	// rw-antidependencies between SerializableSnapshotIsolation transactions.
+	ssi *ssiTracker
+
+	// pessimistic key locks, see lock.go.
+	locks *lockManager
+	// nil unless deadlocks are detected periodically.
+	deadlockDetector *deadlockDetector
+	// see WithBlockingWrites and WithWriteConflicts.
+	blockingWrites bool
+	writeConflicts WriteConflictPolicy
+
+	// nil unless the database was opened WithRecorder.
+	recorder *Recorder
+
+	// only one vacuum runs at a time. The write counter tells the auto vacuum whether there is anything worth reclaiming.
+	vacuumMu          sync.Mutex
+	writesSinceVacuum atomic.Int64
+	// the snapshot horizon of the last vacuum. Time-travel transactions can't read as of a snapshot older than that, its versions may be gone.
+	vacuumHorizon atomic.Uint64
+}
+
+// Option configures a database at construction time.
+type Option func(*options)
+
+type options struct {
+	walPath        string
+	syncPolicy     SyncPolicy
+	deadlock       DeadlockConfig
+	blockingWrites bool
+	writeConflicts WriteConflictPolicy
+	recorder       *Recorder
+}
+
+// WithWAL makes the database durable: every begin/set/delete/commit/rollback is appended to the write-ahead log at path before it takes effect,
+// and opening a database on an existing log replays it. Transactions that were in progress when the log ends are rolled back.
+func WithWAL(path string, policy SyncPolicy) Option {
+	return func(o *options) {
+		o.walPath = path
+		o.syncPolicy = policy
+	}
 }
 
-// the database itself will have a default isolation level that each transaction will inherit (for our own convenience in tests).
-// the database will have a mapping of keys to an array of value versions. Later elements in the array will represent newer versions of a value.
+// the database itself will have a default isolation level that each transaction will inherit unless it asks for another one.
+// the database will have an ordered mapping of keys to an array of value versions. Later elements in the array will represent newer versions of a value.
 // the database will also store the next free transaction id it will use to assign ids to new transactions.
 //
-// Note: To be thread-safe: store, transactions, and nextTransactionId should be guarded by a mutex.
+// The database is safe for concurrent use by multiple goroutines, each with its own Connection. Locking is fine-grained:
+//   - storeMu is held only long enough to find (or create) the version chain of a key.
+//   - each version chain has its own lock, so gets/sets on different keys don't contend.
+//   - txMu guards transactions and nextTransactionId. Commit validation holds it exclusively so that two conflicting transactions can't both pass.
+//
+// Lock ordering is always: version chain -> storeMu -> txMu. Code holding txMu must never try to take a version chain lock.
 //
-//	But to keep the code small, this iteration will not use goroutines and thus does not need mutexes.
-func NewDatabase(isolationLevel IsolationLevel) Database {
-	return Database{
+// NewDatabase panics if an option fails to apply (e.g. the write-ahead log can't be opened), use OpenDatabase to handle that error instead.
+func NewDatabase(isolationLevel IsolationLevel, opts ...Option) *Database {
+	d, err := OpenDatabase(isolationLevel, opts...)
+	utils.AssertEq(err, nil, "open database")
+	return d
+}
+
+func OpenDatabase(isolationLevel IsolationLevel, opts ...Option) (*Database, error) {
+	if _, ok := isolationLevelNames[isolationLevel]; !ok {
+		return nil, fmt.Errorf("%w %v", ErrUnknownIsolationLevel, isolationLevel)
+	}
+
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	d := &Database{
 		defaultIsolation: isolationLevel,
-		store:            map[string][]Value{},
 		// the `0` transaction id will be used to mean that
 		// the id was not set. So all valid transaction ids
 		// must start at 1.
 		nextTransactionId: 1,
+		ssi:               newSSITracker(),
+		locks:             newLockManager(o.deadlock),
+		blockingWrites:    o.blockingWrites,
+		writeConflicts:    o.writeConflicts,
+		recorder:          o.recorder,
+	}
+
+	if o.walPath != "" {
+		w, records, err := openWAL(o.walPath, o.syncPolicy)
+		if err != nil {
+			return nil, err
+		}
+		d.wal = w
+		if err := d.replay(records); err != nil {
+			w.close()
+			return nil, err
+		}
+	}
+
+	if o.deadlock.Interval > 0 {
+		d.deadlockDetector = startDeadlockDetector(d.locks, o.deadlock.Interval)
 	}
+
+	return d, nil
+}
+
+// Close stops the deadlock detector and flushes and closes the write-ahead log, if any. The database must not be used afterwards.
+func (d *Database) Close() error {
+	d.deadlockDetector.close()
+	return d.wal.close()
 }
 
 func (d *Database) NewConnection() *Connection {
-	return &Connection{
+	c := &Connection{
 		db: d,
 		tx: nil,
 	}
+	if d.recorder != nil {
+		c.process = d.recorder.newProcess()
+	}
+	return c
 }
 
+// chain returns the version chain for key. When create is false and the key was never written, nil is returned.
+func (d *Database) chain(key string, create bool) *versionChain {
+	d.storeMu.RLock()
+	chain, ok := d.store.Get(key)
+	d.storeMu.RUnlock()
+	if ok || !create {
+		return chain
+	}
+
+	d.storeMu.Lock()
+	defer d.storeMu.Unlock()
+	// someone else may have created it between the two locks.
+	if chain, ok = d.store.Get(key); !ok {
+		chain = &versionChain{}
+		d.store.Set(key, chain)
+	}
+	return chain
+}
+
+type keyedChain struct {
+	key   string
+	chain *versionChain
+}
+
+// chainsFrom returns the version chains of all keys from start (inclusive) in ascending order, until stop returns true for a key.
+// the chains are not locked, and any of them may be emptied by the time the caller gets to it.
+func (d *Database) chainsFrom(start string, stop func(key string) bool) []keyedChain {
+	d.storeMu.RLock()
+	defer d.storeMu.RUnlock()
+
+	var chains []keyedChain
+	d.store.Ascend(start, func(key string, chain *versionChain) bool {
+		if stop(key) {
+			return false
+		}
+		chains = append(chains, keyedChain{key, chain})
+		return true
+	})
+	return chains
+}
+
+// the value of the version t sees in chain, if any. must be called with the chain locked.
+func (d *Database) visibleValue(t *Transaction, chain *versionChain) (string, bool) {
+	for i := len(chain.versions) - 1; i > -1; i-- {
+		value := chain.versions[i]
+		utils.Debug(value, t, d.isVisible(t, value))
+		if d.isVisible(t, value) {
+			return value.value, true
+		}
+	}
+	return "", false
+}
+
+// lockChain returns the version chain for key with its write lock held, or nil when create is false and the key doesn't exist.
+// a chain found to be emptied and removed by vacuum in the meantime is looked up again.
+func (d *Database) lockChain(key string, create bool) *versionChain {
+	for {
+		chain := d.chain(key, create)
+		if chain == nil {
+			return nil
+		}
+		chain.mu.Lock()
+		if !chain.removed {
+			return chain
+		}
+		chain.mu.Unlock()
+	}
+}
+
+// rlockChain is lockChain for readers, it returns the chain with its read lock held.
+func (d *Database) rlockChain(key string, create bool) *versionChain {
+	for {
+		chain := d.chain(key, create)
+		if chain == nil {
+			return nil
+		}
+		chain.mu.RLock()
+		if !chain.removed {
+			return chain
+		}
+		chain.mu.RUnlock()
+	}
+}
+
+// must be called with txMu held.
 func (d *Database) inprogress() btree.Set[uint64] {
 	var ids btree.Set[uint64]
 	iter := d.transactions.Iter()
@@ -51,30 +245,72 @@ func (d *Database) inprogress() btree.Set[uint64] {
 	return ids
 }
 
-func (d *Database) newTransaction() *Transaction {
+// newTransaction begins a transaction. With asOf > 0 it is a read-only time-travel transaction, see TxOptions.AsOf.
+func (d *Database) newTransaction(isolation IsolationLevel, asOf uint64) (*Transaction, error) {
+	if _, ok := isolationLevelNames[isolation]; !ok {
+		return nil, fmt.Errorf("%w %v", ErrUnknownIsolationLevel, isolation)
+	}
+
 	t := Transaction{}
-	t.isolation = d.defaultIsolation
+	t.isolation = isolation
 	t.state = InProgressTransaction
 
+	d.txMu.Lock()
+	defer d.txMu.Unlock()
+
+	// the snapshot: everything committed so far.
+	t.startTs = d.lastCommitTs
+
+	// a time-travel transaction takes over the snapshot of the transaction it reads as of.
+	if asOf > 0 {
+		if asOf >= d.nextTransactionId {
+			return nil, fmt.Errorf("%w %d", ErrUnknownTransaction, asOf)
+		}
+		past, ok := d.transactions.Get(asOf)
+		if !ok || past.startTs < d.vacuumHorizon.Load() {
+			return nil, fmt.Errorf("%w: vacuum removed versions visible to transaction %d", ErrSnapshotTooOld, asOf)
+		}
+		// whether its own writes are part of the snapshot isn't decided yet, reads would change once it is.
+		if past.state == InProgressTransaction {
+			return nil, fmt.Errorf("%w %d: still in progress", ErrUnknownTransaction, asOf)
+		}
+
+		t.isolation = RepeatableReadIsolation
+		t.asOf = asOf
+		t.startTs = past.startTs
+	}
+
 	// Assign and increment transaction id.
 	t.id = d.nextTransactionId
 	d.nextTransactionId++
 
-	// Store all inprogress transaction ids.
-	t.inprogress = d.inprogress()
+	if err := d.wal.append(walRecord{typ: walBegin, txId: t.id, isolation: t.isolation}); err != nil {
+		return nil, err
+	}
+
+	t.work = d.locks.begin(t.id)
 
 	// Add this transaction to history.
 	d.transactions.Set(t.id, t)
 
+	if t.isolation == SerializableSnapshotIsolation {
+		d.ssi.register(t.id)
+	}
+
 	utils.Debug("starting transaction", t.id)
 
-	return &t
+	return &t, nil
 }
 
 // few more helpers for completing a transaction, for fetching a transaction by id, and for validating a transaction.
 func (d *Database) completeTransaction(t *Transaction, state TransactionState) error {
 	utils.Debug("completing transaction ", t.id)
 
+	d.txMu.Lock()
+	defer d.txMu.Unlock()
+
+	// validating and publishing the new state happen under the same exclusive lock, otherwise two conflicting transactions could
+	// both validate against the history before either of them is marked committed.
 	if state == CommittedTransaction {
 		// Snapshot Isolation
 		// In a snapshot isolated system, each transaction appears to operate on an independent, consistent snapshot of the database.
@@ -82,12 +318,12 @@ func (d *Database) completeTransaction(t *Transaction, state TransactionState) e
 		// If transaction T1 has modified an object x, and another transaction T2 committed a write to x after T1’s snapshot began, and before T1’s commit, then T1 must abort.
 		// Snapshot Isolation is the same as Repeatable Read but with one additional rule: the keys written by any two concurrent committed transactions must not overlap.
 		// https://jepsen.io/consistency/models/snapshot-isolation
-		if t.isolation == SnapshotIsolation {
-			if d.hasConflict(t, func(t1 *Transaction, t2 *Transaction) bool {
-				return setsShareKeys(t1.writeset, t2.writeset)
-			}) {
-				d.completeTransaction(t, RolledBackTransaction)
-				return fmt.Errorf("write-write conflict")
+		if t.isolation == SnapshotIsolation || t.isolation == SerializableSnapshotIsolation {
+			if other, keys, found := d.hasConflict(t, func(t1 *Transaction, t2 *Transaction) []string {
+				return sharedKeys(t1.writeset, t2.writeset)
+			}); found {
+				d.abortTransaction(t)
+				return &ConflictError{Kind: WriteWriteConflict, TxId: t.id, OtherTxId: other, Keys: keys}
 			}
 		}
 
@@ -95,28 +331,87 @@ func (d *Database) completeTransaction(t *Transaction, state TransactionState) e
 		// In terms of end-result, this is the simplest isolation level to reason about. Serializable Isolation must appear as if only a single transaction were executing at a time.
 		// Some systems, like SQLite and TigerBeetle, do Actually Serial Execution where only one transaction runs at a time.
 		// But few databases implement Serializable like this because it removes a number of fair concurrent execution histories. For example, two concurrent read-only transactions.
-		// Postgres implements serializability via Serializable Snapshot Isolation. MySQL implements serializability via Two-Phase Locking.
+		// Postgres implements serializability via Serializable Snapshot Isolation. MySQL implements serializability via Two-Phase Locking, like TwoPhaseLockingSerializableIsolation
+		// (nothing to check here for that one, its locks already kept every conflicting transaction waiting).
 		// FoundationDB implements serializability via sequential timestamp assignment and conflict detection.
 		// https://jepsen.io/consistency/models/serializable
 		if t.isolation == SerializableIsolation {
-			if d.hasConflict(t, func(t1 *Transaction, t2 *Transaction) bool {
-				return setsShareKeys(t1.readset, t2.writeset) || setsShareKeys(t1.writeset, t2.readset) || setsShareKeys(t1.writeset, t2.writeset)
-			}) {
-				d.completeTransaction(t, RolledBackTransaction)
-				return fmt.Errorf("read-write or write-write conflict")
+			if other, keys, found := d.hasConflict(t, func(t1 *Transaction, t2 *Transaction) []string {
+				// a writer at another level only conflicts by writing the same keys, see IsolationLevel.
+				if t2.isolation != SerializableIsolation {
+					return sharedKeys(t1.writeset, t2.writeset)
+				}
+				keys := sharedKeys(t1.readset, t2.writeset)
+				keys = append(keys, sharedKeys(t1.writeset, t2.readset)...)
+				keys = append(keys, sharedKeys(t1.writeset, t2.writeset)...)
+				// phantoms: a key written inside a range the other one scanned.
+				keys = append(keys, keysInRanges(t1.rangeReads, t2.writeset)...)
+				keys = append(keys, keysInRanges(t2.rangeReads, t1.writeset)...)
+				slices.Sort(keys)
+				return slices.Compact(keys)
+			}); found {
+				d.abortTransaction(t)
+				return &ConflictError{Kind: ReadWriteConflict, TxId: t.id, OtherTxId: other, Keys: keys}
+			}
+		}
+
+		// Serializable Snapshot Isolation
+		// Snapshot Isolation plus a check for two consecutive rw-antidependencies among concurrent transactions, see ssi.go.
+		if t.isolation == SerializableSnapshotIsolation {
+			if other, ok := d.ssi.commit(t.id, d.lastCommitTs+1); !ok {
+				d.abortTransaction(t)
+				return &ConflictError{Kind: RWAntidependencyConflict, TxId: t.id, OtherTxId: other}
 			}
 		}
 	}
 
-	// update transactions.
-	t.state = state
-	d.transactions.Set(t.id, *t)
+	// the outcome must be durable before anyone can observe it.
+	typ := walCommit
+	if state == RolledBackTransaction {
+		typ = walRollback
+	}
+	if err := d.wal.append(walRecord{typ: typ, txId: t.id}); err != nil {
+		d.abortTransaction(t)
+		return err
+	}
+
+	d.finishTransaction(t, state)
 
 	return nil
 }
 
+// roll back a transaction that could not commit. The rollback record is best effort: a transaction without an outcome in the log is rolled back
+// by recovery anyway. must be called with txMu held.
+func (d *Database) abortTransaction(t *Transaction) {
+	if err := d.wal.append(walRecord{typ: walRollback, txId: t.id}); err != nil {
+		utils.Debug("logging rollback of transaction", t.id, "failed:", err)
+	}
+	d.finishTransaction(t, RolledBackTransaction)
+}
+
+// update transactions. A commit gets the next commit timestamp, publishing it and the state together makes the commit visible to every
+// transaction that begins from now on, and to none that began before. must be called with txMu held.
+func (d *Database) finishTransaction(t *Transaction, state TransactionState) {
+	if state == RolledBackTransaction && t.isolation == SerializableSnapshotIsolation {
+		d.ssi.abort(t.id)
+	}
+
+	// locks are held until the very end, the outcome is published in the same critical section.
+	d.locks.release(t.id)
+
+	if state == CommittedTransaction {
+		d.lastCommitTs++
+		t.commitTs = d.lastCommitTs
+		d.commits.Set(t.commitTs, t.id)
+	}
+	t.state = state
+	d.transactions.Set(t.id, *t)
+}
+
 func (d *Database) transactionState(txId uint64) Transaction {
+	d.txMu.RLock()
 	t, ok := d.transactions.Get(txId)
+	d.txMu.RUnlock()
 	utils.Assert(ok, "valid transaction")
 	return t
 }
@@ -139,7 +434,8 @@ func (d *Database) isVisible(t *Transaction, value Value) bool {
 	// Moreover we will now begin checking against txEndId to make sure the value wasn't deleted by any relevant transaction.
 	// this is useful and hence is the default isolation level for many databases including Postgres, Yugabyte, Oracle, and SQL Server
 	// https://jepsen.io/consistency/models/read-committed
-	if t.isolation == ReadCommittedIsolation {
+	// two-phase locking reads the same way, its locks keep what it read from changing until it ends.
+	if t.isolation == ReadCommittedIsolation || t.isolation == TwoPhaseLockingSerializableIsolation {
 		// If the value wasn't created by current transaction and the other transaction that created it isn't committed yet, then it's no good.
 		if value.txStartId != t.id && d.transactionState(value.txStartId).state != CommittedTransaction {
 			return false
@@ -148,12 +444,9 @@ func (d *Database) isVisible(t *Transaction, value Value) bool {
 		// If the value was deleted ...
 		if value.txEndId > 0 {
 			// ... in the current transaction, then it's no good
-			if value.txEndId == t.id {
-				return false
-			}
-
 			// ... by other transaction that is committed, then it's no good.
-			if d.transactionState(value.txEndId).state == CommittedTransaction {
+			// more than one transaction can have deleted it, see Value.priorEnds.
+			if value.endedBy(func(id uint64) bool { return id == t.id || d.transactionState(id).state == CommittedTransaction }) {
 				return false
 			}
 		}
@@ -166,45 +459,31 @@ func (d *Database) isVisible(t *Transaction, value Value) bool {
 		// Another transaction B may have committed changes between two statements in this transaction A.
 	}
 
-	// Repeatable Read, Snapshot Isolation and Serializable further restricts Read Committed so only versions from transactions that completed before this one started are 	visible.
-	// we will add additional checks for the Read Committed logic that make sure the value was not created and not deleted within a transaction that started before this transaction started.
+	// Repeatable Read, Snapshot Isolation and Serializable further restricts Read Committed so only versions from transactions that completed before this one started are visible.
+	// instead of "committed", the creating and deleting transactions must have committed at or before the snapshot of the current transaction: its startTs.
 	// https://jepsen.io/consistency/models/repeatable-read
 	// As it happens, this is the same logic that will be necessary for Snapshot Isolation and Serializable Isolation.
 	// The additional logic (that makes Snapshot Isolation and Serializable Isolation different) happens at commit time.
 
-	utils.Assert(t.isolation == RepeatableReadIsolation || t.isolation == SnapshotIsolation || t.isolation == SerializableIsolation, "unsupported isolation level")
+	utils.Assert(t.isolation == RepeatableReadIsolation || t.isolation == SnapshotIsolation || t.isolation == SerializableIsolation ||
+		t.isolation == SerializableSnapshotIsolation, "unsupported isolation level")
 
 	////// now the specifics for a RepeatableReadIsolation level and above, rest of the checks for stricter isolation levels happens at Commit Time.
 
-	// ignore values from transactions started after the current one
-	if value.txStartId > t.id {
-		return false
-	}
+	////// a copy of all checks we did for ReadCommittedIsolation is below with slight **MODIFICATION**: committed becomes committed within the snapshot.
 
-	// ignore values created from transactions in-progress i.e. ongoing when this transaction began but may have committed when this transaction was in progress.
-	// if we didn't check for this, then our current transaction may have performed some reads at the beginning, then an in-progress transaction committed and if we made
-	// another read, we might see the values because now that would be a committed transaction as per ReadCommittedIsolation level. Thus it would be a dirty read and violate
-	// RepeatableReadIsolation guarantee.
-	if t.inprogress.Contains(value.txStartId) {
-		return false
-	}
-
-	////// a copy of all checks we did for ReadUncommittedIsolation is below with slight **MODIFICATION** to the second statement in the bigger IF block
-
-	// If the value wasn't created by current transaction and the other transaction that created it isn't committed yet, then it's no good.
-	if value.txStartId != t.id && d.transactionState(value.txStartId).state != CommittedTransaction {
+	// If the value wasn't created by current transaction and the other transaction that created it didn't commit before this transaction began, then it's no good.
+	// a transaction that was still in-progress when this one began is not part of our snapshot even if it has committed since, otherwise a second read could see
+	// values the first one didn't. Thus it would be a non-repeatable read and violate RepeatableReadIsolation guarantee.
+	if value.txStartId != t.id && !d.inSnapshot(t, value.txStartId) {
 		return false
 	}
 
 	// If the value was deleted ...
 	if value.txEndId > 0 {
 		// ... in the current transaction, then it's no good
-		if value.txEndId == t.id {
-			return false
-		}
-
-		// ... by other transaction **that began before the current one** and it is committed, then it's no good.
-		if value.txEndId < t.id && d.transactionState(value.txEndId).state == CommittedTransaction {
+		// ... by other transaction that committed before the current one began, then it's no good.
+		if value.endedBy(func(id uint64) bool { return id == t.id || d.inSnapshot(t, id) }) {
 			return false
 		}
 	}
@@ -212,54 +491,41 @@ func (d *Database) isVisible(t *Transaction, value Value) bool {
 	return true
 }
 
-// a helper for iterating through all relevant transactions, running a check function for any transaction that has committed.
-func (d *Database) hasConflict(t1 *Transaction, conflictFn func(*Transaction, *Transaction) bool) bool {
-	iter := d.transactions.Iter()
-
-	// first see if there is any conflict with transactions that were in progress when this one started.
-	inprogressIter := t1.inprogress.Iter()
-	for ok := inprogressIter.First(); ok; ok = inprogressIter.Next() {
-		id := inprogressIter.Key()
-		found := iter.Seek(id)
-		if !found {
-			continue
-		}
-		t2 := iter.Value()
-		if t2.state == CommittedTransaction {
-			if conflictFn(t1, &t2) {
-				return true
-			}
-		}
-	}
+// whether the transaction txId is part of the snapshot of t: it committed at or before t's startTs.
+// a time-travel transaction also sees the writes of the transaction it reads as of, if it committed.
+func (d *Database) inSnapshot(t *Transaction, txId uint64) bool {
+	other := d.transactionState(txId)
+	return other.state == CommittedTransaction && (other.commitTs <= t.startTs || txId == t.asOf)
+}
 
-	// then see if there is any conflict with transactions that started and committed after this one started.
-	for id := t1.id; id < d.nextTransactionId; id++ {
-		found := iter.Seek(id)
-		if !found {
-			continue
-		}
-		t2 := iter.Value()
-		if t2.state == CommittedTransaction {
-			if conflictFn(t1, &t2) {
-				return true
-			}
+// a helper for iterating through all relevant transactions, running a check function for any transaction that has committed.
+// the relevant ones are those that committed after t1 began, in commit order: they are exactly the transactions concurrent with t1 that committed first.
+// the check returns the keys the two transactions conflict on, the first transaction with any is returned along with them.
+// must be called with txMu held.
+func (d *Database) hasConflict(t1 *Transaction, conflictFn func(*Transaction, *Transaction) []string) (uint64, []string, bool) {
+	iter := d.commits.Iter()
+	for ok := iter.Seek(t1.startTs + 1); ok; ok = iter.Next() {
+		// vacuum keeps the records of everything that committed after the oldest snapshot.
+		t2, found := d.transactions.Get(iter.Value())
+		utils.Assert(found, "committed transaction in history")
+		if keys := conflictFn(t1, &t2); len(keys) > 0 {
+			return t2.id, keys, true
 		}
 	}
 
-	return false
+	return 0, nil, false
 }
 
-func setsShareKeys(s1 btree.Set[string], s2 btree.Set[string]) bool {
+func sharedKeys(s1 btree.Set[string], s2 btree.Set[string]) []string {
+	var keys []string
 	s1Iter := s1.Iter()
-	s2Iter := s2.Iter()
 
 	for ok := s1Iter.First(); ok; ok = s1Iter.Next() {
-		s1Key := s1Iter.Key()
-		found := s2Iter.Seek(s1Key)
-		if found {
-			return true
+		// Seek would position on the first key >= s1Key, so test for the exact key instead.
+		if s2.Contains(s1Iter.Key()) {
+			keys = append(keys, s1Iter.Key())
 		}
 	}
 
-	return false
+	return keys
 }
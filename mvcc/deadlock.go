@@ -0,0 +1,152 @@
+package mvcc
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// VictimPolicy picks which transaction of a deadlock is rolled back to break it.
+type VictimPolicy uint8
+
+const (
+	// the transaction that began last, it has usually done the least so far and is the cheapest to retry. Postgres instead aborts whichever
+	// transaction notices the deadlock, which is close to this when checking on every wait.
+	VictimYoungest VictimPolicy = iota
+	// the transaction that did the fewest sets and deletes, the youngest of those on a tie. InnoDB does something alike, it weighs the rows
+	// each transaction changed and locked.
+	VictimLeastWork
+)
+
+func (p VictimPolicy) String() string {
+	switch p {
+	case VictimYoungest:
+		return "youngest"
+	case VictimLeastWork:
+		return "least-work"
+	}
+	return fmt.Sprintf("VictimPolicy(%d)", uint8(p))
+}
+
+// whether a should rather be the victim than b. must be called with m.mu held.
+func (p VictimPolicy) prefer(m *lockManager, a uint64, b uint64) bool {
+	if p == VictimLeastWork {
+		workA, workB := m.running[a].Load(), m.running[b].Load()
+		if workA != workB {
+			return workA < workB
+		}
+	}
+	return a > b
+}
+
+// DeadlockConfig tunes the deadlock detector.
+type DeadlockConfig struct {
+	// zero checks for a cycle every time a transaction is about to wait, so a deadlock fails right away. Otherwise a background detector
+	// looks for cycles every Interval: waiting is cheaper, but deadlocked transactions hang until the next run. Close stops the detector.
+	Interval time.Duration
+	Victim   VictimPolicy
+}
+
+// WithDeadlockDetection configures how deadlocks are found and broken, the default is checking on every wait with VictimYoungest.
+func WithDeadlockDetection(config DeadlockConfig) Option {
+	return func(o *options) {
+		o.deadlock = config
+	}
+}
+
+// WithBlockingWrites makes a set or delete of a key with an uncommitted version (or an uncommitted delete) of another transaction wait until
+// that transaction commits or rolls back, the way Postgres and InnoDB writers wait on row locks. Without it the write goes ahead and whichever
+// transaction commits second fails validation, or under read uncommitted and read committed both commit and the first write is overwritten.
+// Waiting can deadlock, see DeadlockConfig. TxOptions.NoWait makes such writes fail with ErrLockNotAvailable instead.
+func WithBlockingWrites() Option {
+	return func(o *options) {
+		o.blockingWrites = true
+	}
+}
+
+// WaitsForGraph maps every waiting transaction to the transactions it waits for, in ascending order.
+type WaitsForGraph map[uint64][]uint64
+
+// one line per waiting transaction, in ascending order: "3 -> 5 7" means transaction 3 waits for transactions 5 and 7.
+func (g WaitsForGraph) String() string {
+	ids := make([]uint64, 0, len(g))
+	for id := range g {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	lines := make([]string, len(ids))
+	for i, id := range ids {
+		lines[i] = fmt.Sprintf("%d -> %s", id, strings.Trim(fmt.Sprint(g[id]), "[]"))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// WaitsFor returns the current waits-for graph, for debugging.
+func (d *Database) WaitsFor() WaitsForGraph {
+	d.locks.mu.Lock()
+	defer d.locks.mu.Unlock()
+	return d.locks.waitsFor()
+}
+
+// whether txId waits for a lock or for another transaction to end.
+func (d *Database) waiting(txId uint64) bool {
+	d.locks.mu.Lock()
+	defer d.locks.mu.Unlock()
+	return d.locks.pending[txId] != nil
+}
+
+// runs lockManager.detect every interval until stop is closed.
+type deadlockDetector struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startDeadlockDetector(m *lockManager, interval time.Duration) *deadlockDetector {
+	dd := &deadlockDetector{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(dd.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-dd.stop:
+				return
+			case <-ticker.C:
+			}
+			m.detect()
+		}
+	}()
+
+	return dd
+}
+
+// a nil detector (when detecting on every wait) has nothing to stop.
+func (dd *deadlockDetector) close() {
+	if dd == nil {
+		return
+	}
+	close(dd.stop)
+	<-dd.done
+}
+
+// the newest transaction other than txId with an uncommitted version of chain or an uncommitted delete of one, if any. For blocking writes
+// and GetForUpdate. must be called with the chain locked.
+func (d *Database) uncommittedWriter(txId uint64, chain *versionChain) uint64 {
+	var writer uint64
+	for _, version := range chain.versions {
+		for _, id := range append([]uint64{version.txStartId, version.txEndId}, version.priorEnds...) {
+			if id > writer && id != txId && d.transactionState(id).state == InProgressTransaction {
+				writer = id
+			}
+		}
+	}
+	return writer
+}
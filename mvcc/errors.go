@@ -0,0 +1,133 @@
+package mvcc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errors returned by the database can be inspected with errors.Is and errors.As instead of comparing their text.
+//
+//	errors.Is(err, ErrNotFound)       // a get or delete of a key the transaction can't see
+//	errors.Is(err, ErrSerialization)  // the transaction was rolled back to preserve its isolation level, retrying it may succeed
+//	errors.Is(err, ErrInvalidCommand) // the command was misused: unknown, wrong arguments, or not valid in the connection's state
+//
+// the concrete *NotFoundError and *ConflictError types carry the details.
+
+var (
+	ErrNotFound = errors.New("key doesn't exist")
+
+	// misuse of a connection. None of these change any state, the connection can keep going.
+	ErrInvalidCommand        = errors.New("invalid command")
+	ErrUnknownCommand        = &commandError{"unknown command"}
+	ErrInvalidArguments      = &commandError{"wrong number of arguments"}
+	ErrNoTransaction         = &commandError{"no transaction in progress, begin one first"}
+	ErrTransactionInProgress = &commandError{"a transaction is already in progress"}
+	ErrUnknownIsolationLevel = &commandError{"unknown isolation level"}
+	ErrTransactionDone       = &commandError{"transaction already committed or rolled back"}
+	ErrNoSavepoint           = &commandError{"no such savepoint"}
+	ErrUnknownTransaction    = &commandError{"no such transaction"}
+	ErrReadOnlyTransaction   = &commandError{"cannot write in a read-only transaction"}
+
+	// another transaction holds a lock the transaction asked for without waiting. Nothing changed, it can try again later.
+	ErrLockNotAvailable = errors.New("could not obtain lock")
+
+	// a call on a transaction ran past TxOptions.StatementTimeout, the transaction keeps going. Also matches context.DeadlineExceeded.
+	ErrStatementTimeout = errors.New("canceling statement due to statement timeout")
+	// the transaction was rolled back after TxOptions.IdleTimeout passed without a call on it.
+	ErrIdleInTransactionTimeout = errors.New("terminating transaction due to idle-in-transaction timeout")
+
+	// vacuum already removed versions that a transaction reading as of a past snapshot would need to see.
+	ErrSnapshotTooOld = errors.New("snapshot too old")
+
+	// every *ConflictError is a serialization failure, on top of the sentinel for its kind.
+	ErrSerialization      = errors.New("serialization failure")
+	ErrWriteWriteConflict = errors.New("write-write conflict")
+	ErrReadWriteConflict  = errors.New("read-write or write-write conflict")
+	ErrRWAntidependency   = errors.New("rw-antidependency conflict")
+	ErrDeadlock           = errors.New("deadlock detected")
+)
+
+type NotFoundError struct {
+	// the command that looked for the key, e.g. "get" or "delete".
+	Command string
+	Key     string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("cannot %s key that doesn't exist", e.Command)
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// each specific misuse is also an ErrInvalidCommand.
+type commandError struct {
+	msg string
+}
+
+func (e *commandError) Error() string {
+	return e.msg
+}
+
+func (e *commandError) Is(target error) bool {
+	return target == ErrInvalidCommand
+}
+
+type ArgumentError struct {
+	Command string
+	Usage   string
+	Got     int
+}
+
+func (e *ArgumentError) Error() string {
+	return fmt.Sprintf("%s takes %q, got %d arguments", e.Command, e.Usage, e.Got)
+}
+
+func (e *ArgumentError) Unwrap() error {
+	return ErrInvalidArguments
+}
+
+type ConflictKind uint8
+
+const (
+	// Snapshot Isolation: both transactions wrote the same keys.
+	WriteWriteConflict ConflictKind = iota
+	// Serializable: one transaction read (or scanned a range over) keys the other wrote, or both wrote the same keys.
+	ReadWriteConflict
+	// Serializable Snapshot Isolation: committing would complete a dangerous structure of rw-antidependencies.
+	RWAntidependencyConflict
+	// waiting for a lock would have closed a cycle of transactions waiting for each other.
+	DeadlockConflict
+)
+
+var conflictSentinels = map[ConflictKind]error{
+	WriteWriteConflict:       ErrWriteWriteConflict,
+	ReadWriteConflict:        ErrReadWriteConflict,
+	RWAntidependencyConflict: ErrRWAntidependency,
+	DeadlockConflict:         ErrDeadlock,
+}
+
+// ConflictError is returned when the transaction had to be rolled back because of a concurrent transaction. Mostly by commit,
+// but a deadlock or a locking read of an outdated snapshot (see Tx.GetForUpdate) end the transaction right where they are found.
+type ConflictError struct {
+	Kind ConflictKind
+	// the transaction that was rolled back, and the concurrent transaction it conflicted with.
+	TxId      uint64
+	OtherTxId uint64
+	// the keys both touched. Empty for rw-antidependency conflicts, those are tracked between transactions rather than keys,
+	// for deadlocks the key the transaction was about to wait for (empty when waiting for a range).
+	Keys []string
+}
+
+func (e *ConflictError) Error() string {
+	msg := fmt.Sprintf("%v: transaction %d conflicts with transaction %d", conflictSentinels[e.Kind], e.TxId, e.OtherTxId)
+	if len(e.Keys) > 0 {
+		msg += fmt.Sprintf(" on %v", e.Keys)
+	}
+	return msg
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrSerialization || target == conflictSentinels[e.Kind]
+}
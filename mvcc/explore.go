@@ -0,0 +1,484 @@
+package mvcc
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mukeshjc/mvcc-isolation/v2/utils"
+)
+
+// the explorer is a small stateless model checker: it runs a few transaction programs in every possible interleaving of their commands, each
+// on a fresh database, and compares how each interleaving ended with how the programs end when run one after the other. A level that claims
+// serializability must never end differently from every serial order. Bugs in visibility and conflict checks tend to hide in one or two
+// interleavings that random workloads rarely hit, here they can't hide.
+//
+// there is no way to snapshot a database halfway through a schedule, so every interleaving is replayed from the start. That's cheap for what
+// this is meant for: two or three programs of a handful of commands. k programs of n commands have (k*(n+2))! / ((n+2)!)^k interleavings.
+
+// Program is one transaction: the commands it runs between begin and commit, as a Connection takes them, e.g. {"get", "x"} or {"set", "x", "1"}.
+// It runs at the database's level. A program may end itself earlier with {"rollback"}.
+type Program [][]string
+
+type ExploreConfig struct {
+	Level IsolationLevel
+	// the keys and values committed before the programs run.
+	Initial map[string]string
+	// applied to every database the programs run on, e.g. WithBlockingWrites. Not WithWAL, every run would replay the one before.
+	Options []Option
+}
+
+// ScheduleStep is one command of a schedule.
+type ScheduleStep struct {
+	// the program running the command, numbered from 1.
+	Program int
+	Command []string
+	// what the command returned, or the error it failed with prefixed by "error: ".
+	Result string
+	// whether the command had to wait for another program before it returned.
+	Waited bool
+}
+
+// Schedule is an interleaving of the programs' commands, in the order they were issued.
+type Schedule []ScheduleStep
+
+// one command per line, e.g. `T2 get x -> "1"`.
+func (s Schedule) String() string {
+	lines := make([]string, len(s))
+	for i, step := range s {
+		waited := ""
+		if step.Waited {
+			waited = " (waited)"
+		}
+		lines[i] = fmt.Sprintf("T%d %s -> %q%s", step.Program, strings.Join(step.Command, " "), step.Result, waited)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// how often the schedule switches from one program to another, the fewer the easier it is to follow.
+func (s Schedule) switches() int {
+	n := 0
+	for i := 1; i < len(s); i++ {
+		if s[i].Program != s[i-1].Program {
+			n++
+		}
+	}
+	return n
+}
+
+type Counterexample struct {
+	Schedule Schedule
+	// how the schedule ended, and how every serial execution of the programs it committed ends instead.
+	Outcome string
+	Serial  []string
+}
+
+type Exploration struct {
+	Level     IsolationLevel
+	Schedules int
+	// how many schedules ended in an outcome no serial execution has.
+	NonSerializable int
+	// the non-serializable schedules with the fewest switches between programs, in the order they were found.
+	Counterexamples []Counterexample
+}
+
+// Violated reports whether the level claims serializability but a schedule wasn't serializable. Non-serializable outcomes are fine for weaker
+// levels, the counterexamples then show the anomalies they allow.
+func (e *Exploration) Violated() bool {
+	return e.Level.serializable() && e.NonSerializable > 0
+}
+
+func (e *Exploration) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v: %d schedules, %d not serializable", e.Level, e.Schedules, e.NonSerializable)
+	for _, c := range e.Counterexamples {
+		fmt.Fprintf(&b, "\n\n%v\noutcome: %s\nserial:  %s", c.Schedule, c.Outcome, strings.Join(c.Serial, "\n         "))
+	}
+	return b.String()
+}
+
+// Explore runs programs in every interleaving and collects the ones that end in an outcome no serial execution of the programs that committed
+// ends in. An outcome is which programs committed, what their commands returned, and the final value of every key the programs touch.
+// Programs that didn't commit don't count, serializability is only about committed transactions.
+func Explore(config ExploreConfig, programs ...Program) *Exploration {
+	e := &explorer{config: config, programs: programs, serial: map[uint64][]string{}}
+	for key := range config.Initial {
+		e.keys = append(e.keys, key)
+	}
+	for _, p := range programs {
+		for _, cmd := range p {
+			if len(cmd) > 1 && slices.Contains([]string{"get", "getforupdate", "set", "delete"}, cmd[0]) && !slices.Contains(e.keys, cmd[1]) {
+				e.keys = append(e.keys, cmd[1])
+			}
+		}
+	}
+	slices.Sort(e.keys)
+
+	e.result = &Exploration{Level: config.Level}
+	e.explore(e.start())
+	return e.result
+}
+
+type explorer struct {
+	config   ExploreConfig
+	programs []Program
+	keys     []string
+
+	// the outcomes of every serial order of a set of programs, by the bit mask of the set.
+	serial map[uint64][]string
+	result *Exploration
+}
+
+// Driver interleaves the calls of a few connections one step at a time, in the order they are issued, the way a schedule does. Every
+// connection runs its calls in a goroutine of its own: a call that waits for a lock doesn't hold up the calls of other connections, and later
+// calls of its own connection queue up behind it. Explore runs its schedules on a Driver, tests can run hand-written ones the same way.
+//
+// a Driver isn't safe for concurrent use, it is meant to be driven from a single goroutine.
+type Driver struct {
+	database *Database
+	conns    []*driverConn
+	// how many calls returned so far, across all connections.
+	returned atomic.Int64
+}
+
+type driverConn struct {
+	conn *Connection
+	// the calls issued that haven't returned yet, oldest first. Only the oldest one is running.
+	outstanding []*DriverCall
+	queued      atomic.Int64
+	// the transaction the connection runs, known once the call beginning it returned. Beginning never waits.
+	txId atomic.Uint64
+}
+
+// DriverCall is a call issued by a Driver.
+type DriverCall struct {
+	// what the call returned, set once it is done.
+	Result string
+	Err    error
+	// whether the call had to wait for another transaction before it returned.
+	Waited bool
+
+	done chan struct{}
+}
+
+// Done reports whether the call returned.
+func (c *DriverCall) Done() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewDriver returns a Driver for database. Its connections are numbered from 0 and opened on first use.
+func NewDriver(database *Database) *Driver {
+	return &Driver{database: database}
+}
+
+// Step issues call on connection i and returns once the call returned or waits for a lock, or right away when it queued up behind an earlier
+// call of the connection that still waits. A call returning may end its transaction and let waiting calls of other connections go on, Step
+// also waits until those returned or wait again, so the same steps always end up in the same state.
+//
+// Step only knows a call waits once the connection's transaction is known, which is when the call that began it returned: begin in a call
+// of its own.
+func (d *Driver) Step(i int, call func(c *Connection) (string, error)) *DriverCall {
+	for len(d.conns) <= i {
+		d.conns = append(d.conns, &driverConn{conn: d.database.NewConnection()})
+	}
+	dc := d.conns[i]
+
+	c := &DriverCall{done: make(chan struct{})}
+	var previous *DriverCall
+	if n := len(dc.outstanding); n > 0 {
+		previous = dc.outstanding[n-1]
+	}
+	dc.outstanding = append(dc.outstanding, c)
+	dc.queued.Add(1)
+	go func() {
+		if previous != nil {
+			<-previous.done
+		}
+		c.Result, c.Err = call(dc.conn)
+		if dc.conn.tx != nil {
+			dc.txId.Store(dc.conn.tx.ID())
+		}
+		close(c.done)
+		d.returned.Add(1)
+		dc.queued.Add(-1)
+	}()
+
+	d.settle()
+	return c
+}
+
+// Exec is Step running a command, as Connection.ExecCommand takes it.
+func (d *Driver) Exec(i int, command []string) *DriverCall {
+	return d.Step(i, func(c *Connection) (string, error) {
+		return c.ExecCommand(command[0], command[1:])
+	})
+}
+
+// Wait returns once every call issued returned.
+func (d *Driver) Wait() {
+	for _, dc := range d.conns {
+		if n := len(dc.outstanding); n > 0 {
+			<-dc.outstanding[n-1].done
+		}
+		dc.outstanding = nil
+	}
+}
+
+// settle returns once no call is running anymore except calls waiting for a lock. It only returns after a pass over all connections that
+// found every one of them settled and in which no call returned: a call that ran during the pass may have let a call of a connection already
+// passed go on, by returning or by picking it as a deadlock victim.
+func (d *Driver) settle() {
+	for {
+		returned := d.returned.Load()
+		quiet := true
+		for _, dc := range d.conns {
+			for !d.settled(dc) {
+				quiet = false
+				runtime.Gosched()
+			}
+		}
+		if quiet && d.returned.Load() == returned {
+			return
+		}
+	}
+}
+
+// whether dc has no call running, or the one running waits for a lock. The lock manager only knows a waiting transaction once it queued its
+// request, until then the call counts as running.
+func (d *Driver) settled(dc *driverConn) bool {
+	if dc.queued.Load() == 0 {
+		return true
+	}
+	if id := dc.txId.Load(); id > 0 && d.database.waiting(id) {
+		for len(dc.outstanding) > 1 && dc.outstanding[0].Done() {
+			dc.outstanding = dc.outstanding[1:]
+		}
+		dc.outstanding[0].Waited = true
+		return true
+	}
+	return false
+}
+
+// one schedule running against its own database.
+type run struct {
+	e        *explorer
+	database *Database
+	driver   *Driver
+	programs []*runningProgram
+	schedule Schedule
+}
+
+type runningProgram struct {
+	commands [][]string
+	// the next command to issue.
+	next  int
+	ended bool
+
+	// the outstanding command and its position in the schedule, nil when there is none.
+	call        *DriverCall
+	outstanding int
+
+	committed bool
+	results   []string
+}
+
+func (e *explorer) start() *run {
+	database, err := OpenDatabase(e.config.Level, e.config.Options...)
+	utils.AssertEq(err, nil, "open database")
+
+	if len(e.config.Initial) > 0 {
+		c := database.NewConnection()
+		c.MustExecCommand("begin", nil)
+		for key, value := range e.config.Initial {
+			c.MustExecCommand("set", []string{key, value})
+		}
+		c.MustExecCommand("commit", nil)
+	}
+
+	r := &run{e: e, database: database, driver: NewDriver(database)}
+	for _, p := range e.programs {
+		commands := append([][]string{{"begin"}}, p...)
+		commands = append(commands, []string{"commit"})
+		r.programs = append(r.programs, &runningProgram{commands: commands})
+	}
+	return r
+}
+
+// the programs that can issue their next command, in order: the ones that neither ended nor wait.
+func (r *run) enabled() []int {
+	var enabled []int
+	for i, p := range r.programs {
+		if !p.ended && p.call == nil {
+			enabled = append(enabled, i)
+		}
+	}
+	return enabled
+}
+
+// step issues the next command of program i, see Driver.Step.
+func (r *run) step(i int) {
+	p := r.programs[i]
+	cmd := p.commands[p.next]
+	p.next++
+
+	p.outstanding = len(r.schedule)
+	r.schedule = append(r.schedule, ScheduleStep{Program: i + 1, Command: cmd})
+	p.call = r.driver.Exec(i, cmd)
+
+	// the commands that returned by now, the waiting ones of others included.
+	for j, p := range r.programs {
+		if p.call != nil && p.call.Done() {
+			r.finish(j, p)
+		}
+	}
+}
+
+// finish records what the outstanding command of program i returned.
+func (r *run) finish(i int, p *runningProgram) {
+	step := &r.schedule[p.outstanding]
+	step.Result, step.Waited = p.call.Result, p.call.Waited
+	if p.call.Err != nil {
+		step.Result = "error: " + p.call.Err.Error()
+	}
+
+	switch cmd := step.Command[0]; {
+	case p.next == 1:
+		utils.AssertEq(p.call.Err, nil, "begin")
+	case r.driver.conns[i].conn.tx == nil:
+		// committed, rolled back, or rolled back by a failure.
+		p.ended = true
+		p.committed = cmd == "commit" && p.call.Err == nil
+	default:
+		p.results = append(p.results, step.Result)
+	}
+	p.call = nil
+}
+
+// how the run ended, see Explore. Every program must have ended.
+func (r *run) outcome() string {
+	var parts []string
+	for i, p := range r.programs {
+		utils.Assert(p.ended || p.next == 0, "every program ended")
+		if p.committed {
+			parts = append(parts, fmt.Sprintf("T%d %q", i+1, p.results))
+		}
+	}
+
+	c := r.database.NewConnection()
+	c.MustExecCommand("begin", nil)
+	var final []string
+	for _, key := range r.e.keys {
+		if value, err := c.ExecCommand("get", []string{key}); err == nil {
+			final = append(final, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+	c.MustExecCommand("commit", nil)
+	return fmt.Sprintf("committed %s, final %s", strings.Join(parts, " "), strings.Join(final, " "))
+}
+
+// the bit mask of the programs that committed.
+func (r *run) committed() uint64 {
+	var mask uint64
+	for i, p := range r.programs {
+		if p.committed {
+			mask |= 1 << i
+		}
+	}
+	return mask
+}
+
+// explore runs every schedule that continues the one r ran so far, r itself runs the first of them.
+func (e *explorer) explore(r *run) {
+	enabled := r.enabled()
+	if len(enabled) == 0 {
+		e.check(r)
+		return
+	}
+
+	prefix := slices.Clone(r.schedule)
+	for n, i := range enabled {
+		if n > 0 {
+			r = e.replay(prefix)
+		}
+		r.step(i)
+		e.explore(r)
+	}
+}
+
+// replay runs a schedule that was run before on a fresh database. Runs are deterministic, the waits happen the same way again.
+func (e *explorer) replay(schedule Schedule) *run {
+	r := e.start()
+	for _, step := range schedule {
+		r.step(step.Program - 1)
+	}
+	return r
+}
+
+func (e *explorer) check(r *run) {
+	e.result.Schedules++
+
+	outcome := r.outcome()
+	r.database.Close()
+	serial := e.serialOutcomes(r.committed())
+	if slices.Contains(serial, outcome) {
+		return
+	}
+	e.result.NonSerializable++
+
+	c := Counterexample{Schedule: r.schedule, Outcome: outcome, Serial: serial}
+	if len(e.result.Counterexamples) > 0 {
+		switch fewest := e.result.Counterexamples[0].Schedule.switches(); {
+		case c.Schedule.switches() > fewest:
+			return
+		case c.Schedule.switches() < fewest:
+			e.result.Counterexamples = nil
+		}
+	}
+	e.result.Counterexamples = append(e.result.Counterexamples, c)
+}
+
+// the outcomes of running the programs in mask one after the other, in every order.
+func (e *explorer) serialOutcomes(mask uint64) []string {
+	if outcomes, ok := e.serial[mask]; ok {
+		return outcomes
+	}
+
+	var programs []int
+	for i := range e.programs {
+		if mask&(1<<i) != 0 {
+			programs = append(programs, i)
+		}
+	}
+
+	var outcomes []string
+	var permute func(order []int, rest []int)
+	permute = func(order []int, rest []int) {
+		if len(rest) == 0 {
+			r := e.start()
+			for _, i := range order {
+				for !r.programs[i].ended {
+					r.step(i)
+				}
+			}
+			if outcome := r.outcome(); !slices.Contains(outcomes, outcome) {
+				outcomes = append(outcomes, outcome)
+			}
+			r.database.Close()
+			return
+		}
+		for n, i := range rest {
+			permute(append(slices.Clone(order), i), append(slices.Clone(rest[:n]), rest[n+1:]...))
+		}
+	}
+	permute(nil, programs)
+
+	e.serial[mask] = outcomes
+	return outcomes
+}
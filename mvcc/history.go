@@ -0,0 +1,112 @@
+package mvcc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Version describes one version in the chain of a key, for debugging.
+type Version struct {
+	Value string
+
+	// the transaction that created the version, and the one that ended it by a set or delete (zero if none did).
+	TxStartId    uint64
+	TxEndId      uint64
+	CreatorState TransactionState
+	// only meaningful when TxEndId is set.
+	EnderState TransactionState
+	// the transactions that ended the version before TxEndId did, oldest first. Without blocking writes more than one transaction can end
+	// a version, the version is deleted as soon as any of them commits.
+	PriorEnds []VersionEnd
+
+	// whether this is the version of the key the transaction asking for the history reads.
+	Visible bool
+}
+
+// VersionEnd is a transaction that ended a version, and its state.
+type VersionEnd struct {
+	TxId  uint64
+	State TransactionState
+}
+
+func (v Version) String() string {
+	mark := " "
+	if v.Visible {
+		mark = "*"
+	}
+	end := "-"
+	if v.TxEndId > 0 {
+		var ends []string
+		for _, e := range append(v.PriorEnds, VersionEnd{TxId: v.TxEndId, State: v.EnderState}) {
+			ends = append(ends, fmt.Sprintf("%d (%v)", e.TxId, e.State))
+		}
+		end = strings.Join(ends, ", ")
+	}
+	return fmt.Sprintf("%s start=%d (%v) end=%s value=%q", mark, v.TxStartId, v.CreatorState, end, v.Value)
+}
+
+// FormatHistory prints one version per line, oldest first, as the "history" command does.
+func FormatHistory(versions []Version) string {
+	lines := make([]string, len(versions))
+	for i, v := range versions {
+		lines[i] = v.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// History returns every version of key still in the database, oldest first, including the ones vacuum hasn't removed yet.
+// A key that doesn't exist has no versions. No version is marked visible, Tx.History does that.
+func (d *Database) History(key string) []Version {
+	return d.history(nil, key)
+}
+
+// History is Database.History, marking the version of key this transaction reads.
+// Looking at the history is not a read: it isn't recorded for the serializable levels.
+func (tx *Tx) History(key string) ([]Version, error) {
+	return tx.HistoryContext(context.Background(), key)
+}
+
+func (tx *Tx) HistoryContext(ctx context.Context, key string) ([]Version, error) {
+	if err := tx.enterContext(ctx); err != nil {
+		return nil, err
+	}
+	defer tx.exit()
+
+	return tx.db.history(tx.t, key), nil
+}
+
+func (d *Database) history(t *Transaction, key string) []Version {
+	chain := d.rlockChain(key, false)
+	if chain == nil {
+		return nil
+	}
+	defer chain.mu.RUnlock()
+
+	versions := make([]Version, len(chain.versions))
+	for i, value := range chain.versions {
+		versions[i] = Version{
+			Value:        value.value,
+			TxStartId:    value.txStartId,
+			TxEndId:      value.txEndId,
+			CreatorState: d.transactionState(value.txStartId).state,
+		}
+		if value.txEndId > 0 {
+			versions[i].EnderState = d.transactionState(value.txEndId).state
+		}
+		for _, id := range value.priorEnds {
+			versions[i].PriorEnds = append(versions[i].PriorEnds, VersionEnd{TxId: id, State: d.transactionState(id).state})
+		}
+	}
+
+	// the newest visible version is the one get returns, see visibleValue.
+	if t != nil {
+		for i := len(chain.versions) - 1; i > -1; i-- {
+			if d.isVisible(t, chain.versions[i]) {
+				versions[i].Visible = true
+				break
+			}
+		}
+	}
+	return versions
+}
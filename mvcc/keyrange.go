@@ -0,0 +1,41 @@
+package mvcc
+
+import "github.com/tidwall/btree"
+
+// a range of keys [start, end). An empty end means the range is unbounded above.
+// point reads are tracked in the readset, but a scan also depends on every key it did *not* find: a concurrent insert into the scanned range
+// is a phantom. So scans record the range itself, and commit-time checks test writes against it.
+type keyRange struct {
+	start string
+	end   string
+}
+
+// every key with the given prefix, i.e. [prefix, the smallest string greater than all keys with the prefix).
+func prefixRange(prefix string) keyRange {
+	end := []byte(prefix)
+	for i := len(end) - 1; i > -1; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return keyRange{start: prefix, end: string(end[:i+1])}
+		}
+	}
+	// empty, or nothing but 0xff bytes: every key from prefix on.
+	return keyRange{start: prefix}
+}
+
+func (r keyRange) contains(key string) bool {
+	return key >= r.start && (r.end == "" || key < r.end)
+}
+
+// the keys that fall into any of the ranges.
+func keysInRanges(ranges []keyRange, keys btree.Set[string]) []string {
+	var found []string
+	for _, r := range ranges {
+		iter := keys.Iter()
+		// unlike sharedKeys, here Seek is exactly what we want: the first written key >= start.
+		for ok := iter.Seek(r.start); ok && r.contains(iter.Key()); ok = iter.Next() {
+			found = append(found, iter.Key())
+		}
+	}
+	return found
+}
@@ -1,6 +1,16 @@
 package mvcc
 
+import (
+	"fmt"
+	"strings"
+)
+
 // loosest isolation at the top, strictest isolation at the bottom.
+//
+// every transaction runs at its own level, the database's level is only the default for begin without one.
+// transactions at different levels can run side by side: each one reads by the visibility rules of its own level, and its own level decides what
+// it is checked against at commit. Like in Postgres, serializable levels only guarantee serializability among transactions at that same level:
+// a read committed writer doesn't take part in the read/write checks of a serializable one, although every level's writes count for write-write conflicts.
 type IsolationLevel uint8
 
 const (
@@ -14,4 +24,84 @@ const (
 	RepeatableReadIsolation
 	SnapshotIsolation
 	SerializableIsolation
+	// as strict as SerializableIsolation, but only aborts transactions that could actually end up in a non-serializable history. See ssi.go.
+	SerializableSnapshotIsolation
+	// serializable the way MySQL's InnoDB does it: pessimistically, by two-phase locking. Every get takes a shared lock on the key, every scan
+	// a shared lock on its range, every set and delete an exclusive lock, and all of them are held until the transaction commits or rolls back.
+	// Conflicting transactions wait for each other instead of failing at commit, so reads return the latest committed version like read committed:
+	// once read, a key can't change until the transaction ends. The price is deadlocks, one of the transactions in a cycle is rolled back.
+	TwoPhaseLockingSerializableIsolation
+)
+
+var isolationLevelNames = map[IsolationLevel]string{
+	ReadUncommittedIsolation: "read-uncommitted",
+	ReadCommittedIsolation:   "read-committed",
+	RepeatableReadIsolation:  "repeatable-read",
+	SnapshotIsolation:        "snapshot",
+	SerializableIsolation:    "serializable",
+
+	SerializableSnapshotIsolation:        "serializable-snapshot",
+	TwoPhaseLockingSerializableIsolation: "two-phase-locking",
+}
+
+func (l IsolationLevel) String() string {
+	if name, ok := isolationLevelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("IsolationLevel(%d)", uint8(l))
+}
+
+// ParseIsolationLevel accepts the names printed by IsolationLevel.String, case-insensitively and with either '-', '_' or ' ' between words.
+func ParseIsolationLevel(name string) (IsolationLevel, error) {
+	normalized := strings.NewReplacer("_", "-", " ", "-").Replace(strings.ToLower(strings.TrimSpace(name)))
+	for level, levelName := range isolationLevelNames {
+		if levelName == normalized {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("%w %q", ErrUnknownIsolationLevel, name)
+}
+
+// WriteConflictPolicy decides when a write-write conflict fails a transaction at the levels that forbid them: snapshot isolation and stricter
+// (two-phase locking aside, its locks never let two transactions write the same key concurrently).
+type WriteConflictPolicy uint8
+
+const (
+	// the conflict is found when the second of the two writers commits, however much work it did before.
+	FirstCommitterWins WriteConflictPolicy = iota
+	// the conflict is found by the set or delete itself: writing a key that a concurrent transaction already wrote fails right away,
+	// whether that transaction committed or is still in progress.
+	FirstUpdaterWinsFail
+	// like FirstUpdaterWinsFail, but writing a key with an uncommitted version of a concurrent transaction first waits for it, the way Postgres
+	// does under repeatable read: if it commits the write fails, if it rolls back the write goes ahead. Waiting can deadlock, see DeadlockConfig.
+	FirstUpdaterWinsWait
 )
+
+func (p WriteConflictPolicy) String() string {
+	switch p {
+	case FirstCommitterWins:
+		return "first-committer-wins"
+	case FirstUpdaterWinsFail:
+		return "first-updater-wins-fail"
+	case FirstUpdaterWinsWait:
+		return "first-updater-wins-wait"
+	}
+	return fmt.Sprintf("WriteConflictPolicy(%d)", uint8(p))
+}
+
+// WithWriteConflicts sets the policy for write-write conflicts, the default is FirstCommitterWins.
+func WithWriteConflicts(policy WriteConflictPolicy) Option {
+	return func(o *options) {
+		o.writeConflicts = policy
+	}
+}
+
+// whether transactions at level fail on write-write conflicts.
+func (l IsolationLevel) forbidsWriteConflicts() bool {
+	return l == SnapshotIsolation || l == SerializableIsolation || l == SerializableSnapshotIsolation
+}
+
+// whether every history of transactions at level is equivalent to some serial execution of them.
+func (l IsolationLevel) serializable() bool {
+	return l == SerializableIsolation || l == SerializableSnapshotIsolation || l == TwoPhaseLockingSerializableIsolation
+}
@@ -0,0 +1,469 @@
+package mvcc
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mukeshjc/mvcc-isolation/v2/utils"
+)
+
+// the lock manager gives transactions pessimistic key locks on top of the optimistic version chains, like SELECT ... FOR UPDATE.
+// locks are held until the transaction commits or rolls back. They don't change what anyone sees: visibility is still decided by the
+// versions alone. They only make transactions wait for each other, so that a conflict that would otherwise be found at commit never happens.
+//
+// every key has the transactions holding a lock on it and a FIFO queue of requests waiting for one. A request is granted once its mode is
+// compatible with every lock held by other transactions, and every request queued before it was granted (so exclusive requests don't starve).
+//
+// besides keys, ranges of keys can be locked in shared mode (predicate locks, for scans under two-phase locking). An exclusive lock on a key
+// and a shared lock on a range containing it conflict, that is what keeps phantoms out.
+//
+// a transaction can also wait for another transaction to end, like Postgres waits on the transaction id of a row's xmax. That is how blocking
+// writes (see WithBlockingWrites) wait for the uncommitted versions of others.
+//
+// waiting for each other, transactions can deadlock. Every waiting transaction is an edge in the waits-for graph, to each transaction it waits
+// for. By default the graph is checked every time a request is about to wait, if the wait would close a cycle a victim in the cycle is picked
+// and fails with a deadlock *ConflictError. Alternatively a background detector looks for cycles periodically, so that waiting stays cheap but
+// deadlocked transactions hang until the next run. See DeadlockConfig.
+//
+// lock ordering: the lock manager's mutex is a leaf, nothing else is locked while holding it. Waiting happens with no lock held at all.
+
+type LockMode uint8
+
+const (
+	SharedLock LockMode = iota + 1
+	ExclusiveLock
+)
+
+func (m LockMode) String() string {
+	switch m {
+	case SharedLock:
+		return "shared"
+	case ExclusiveLock:
+		return "exclusive"
+	}
+	return fmt.Sprintf("LockMode(%d)", uint8(m))
+}
+
+type lockManager struct {
+	mu   sync.Mutex
+	keys map[string]*keyLock
+	// the keys every transaction holds a lock on, to release them at commit or rollback.
+	held map[uint64][]string
+
+	// shared range locks held by every transaction.
+	ranges map[uint64][]keyRange
+	// range requests and requests for the end of a transaction that are waiting, they don't belong to the queue of a single key.
+	waiting []*lockRequest
+	// the request every waiting transaction waits on, a transaction only does one thing at a time.
+	pending map[uint64]*lockRequest
+
+	// the transactions that began and haven't ended yet, with the number of writes each did so far (for VictimLeastWork).
+	running map[uint64]*atomic.Int64
+
+	victim VictimPolicy
+	// with periodic detection requests don't look for cycles before waiting, see detect.
+	periodic bool
+}
+
+type keyLock struct {
+	holders map[uint64]LockMode
+	queue   []*lockRequest
+}
+
+type lockRequest struct {
+	txId uint64
+	mode LockMode
+	// the key, or for a range request the range, or for a request waiting for a transaction to end that transaction.
+	key string
+	r   *keyRange
+	on  uint64
+	// a probe only waits until the lock could be granted, without taking it.
+	probe bool
+	// closed once granted, or once the request was picked as deadlock victim. Then err is set.
+	granted chan struct{}
+	err     error
+}
+
+func newLockManager(config DeadlockConfig) *lockManager {
+	return &lockManager{
+		keys:     map[string]*keyLock{},
+		held:     map[uint64][]string{},
+		ranges:   map[uint64][]keyRange{},
+		pending:  map[uint64]*lockRequest{},
+		running:  map[uint64]*atomic.Int64{},
+		victim:   config.Victim,
+		periodic: config.Interval > 0,
+	}
+}
+
+// begin registers a new transaction, the returned counter is where it counts its writes.
+func (m *lockManager) begin(txId uint64) *atomic.Int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	work := &atomic.Int64{}
+	m.running[txId] = work
+	return work
+}
+
+// the transactions whose locks keep r from being granted. With queued, that includes every incompatible request queued ahead of r:
+// those are granted first. must be called with m.mu held.
+func (m *lockManager) blockers(r *lockRequest, queued bool) []uint64 {
+	var ids []uint64
+
+	if r.on > 0 {
+		if _, ok := m.running[r.on]; ok {
+			ids = append(ids, r.on)
+		}
+		return ids
+	}
+
+	// a range request conflicts with exclusive locks on keys in it.
+	if r.r != nil {
+		for key, l := range m.keys {
+			if !r.r.contains(key) {
+				continue
+			}
+			for holder, held := range l.holders {
+				if holder != r.txId && held == ExclusiveLock {
+					ids = append(ids, holder)
+				}
+			}
+		}
+		return ids
+	}
+
+	if l, ok := m.keys[r.key]; ok {
+		for holder, held := range l.holders {
+			if holder != r.txId && (r.mode == ExclusiveLock || held == ExclusiveLock) {
+				ids = append(ids, holder)
+			}
+		}
+		if _, holding := l.holders[r.txId]; queued && !holding {
+			for _, ahead := range l.queue {
+				if ahead == r {
+					break
+				}
+				if ahead.txId != r.txId && (r.mode == ExclusiveLock || ahead.mode == ExclusiveLock) {
+					ids = append(ids, ahead.txId)
+				}
+			}
+		}
+	}
+
+	// an exclusive key request conflicts with range locks containing the key.
+	if r.mode == ExclusiveLock {
+		for holder, ranges := range m.ranges {
+			if holder == r.txId {
+				continue
+			}
+			for _, locked := range ranges {
+				if locked.contains(r.key) {
+					ids = append(ids, holder)
+					break
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// whether r could be granted right now, ignoring the requests queued ahead of it. must be called with m.mu held.
+func (m *lockManager) compatible(r *lockRequest) bool {
+	return len(m.blockers(r, false)) == 0
+}
+
+// acquire locks key in mode for txId, waiting for other transactions to release it unless wait is false, then it fails with ErrLockNotAvailable.
+// a transaction holding a shared lock upgrades it by asking for an exclusive one.
+// a probe returns once the lock could be granted, without holding it: writers use it to respect locks they don't take.
+// when ctx is done first the request gives up waiting with the cause of ctx (see context.Cause).
+func (m *lockManager) acquire(ctx context.Context, txId uint64, key string, mode LockMode, wait bool, probe bool) error {
+	return m.request(ctx, &lockRequest{txId: txId, mode: mode, key: key, probe: probe}, wait)
+}
+
+// acquireRange takes a shared lock on every key in r, including keys that don't exist yet.
+func (m *lockManager) acquireRange(ctx context.Context, txId uint64, r keyRange, wait bool) error {
+	return m.request(ctx, &lockRequest{txId: txId, mode: SharedLock, r: &r}, wait)
+}
+
+// waitFor waits until the transaction other has committed or rolled back, it returns right away if it already has.
+func (m *lockManager) waitFor(ctx context.Context, txId uint64, other uint64, wait bool) error {
+	utils.Assert(txId != other, "transaction waiting for itself")
+	return m.request(ctx, &lockRequest{txId: txId, on: other, probe: true}, wait)
+}
+
+func (m *lockManager) request(ctx context.Context, r *lockRequest, wait bool) error {
+	m.mu.Lock()
+
+	var l *keyLock
+	holding := false
+	if r.r == nil && r.on == 0 {
+		l = m.keys[r.key]
+		if l == nil {
+			l = &keyLock{holders: map[uint64]LockMode{}}
+			m.keys[r.key] = l
+		}
+
+		var held LockMode
+		held, holding = l.holders[r.txId]
+		if holding && held >= r.mode {
+			m.mu.Unlock()
+			return nil
+		}
+	}
+
+	// a holder upgrading its lock doesn't queue behind requests that wait for it to release that very lock.
+	if (l == nil || holding || len(l.queue) == 0) && m.compatible(r) {
+		if !r.probe {
+			m.grant(r)
+		}
+		m.forget(r.key)
+		m.mu.Unlock()
+		return nil
+	}
+
+	blockers := m.blockers(r, true)
+	if !wait {
+		m.forget(r.key)
+		m.mu.Unlock()
+		if r.on > 0 {
+			return fmt.Errorf("%w: transaction %d is still in progress", ErrLockNotAvailable, r.on)
+		}
+		return fmt.Errorf("%w: %v lock on %v is held by transaction %d", ErrLockNotAvailable, r.mode, r.target(), blockers[0])
+	}
+
+	r.granted = make(chan struct{})
+	if l != nil {
+		l.queue = append(l.queue, r)
+	} else {
+		m.waiting = append(m.waiting, r)
+	}
+	m.pending[r.txId] = r
+
+	// the request may close more than one cycle at once, e.g. when two other holders of a shared lock wait to upgrade it too.
+	// breaking one of them leaves the others, so keep going until none is left or r itself is no longer waiting.
+	if !m.periodic {
+		for m.pending[r.txId] == r {
+			cycle := m.cycleThrough(m.waitsFor(), r.txId)
+			if cycle == nil {
+				break
+			}
+			m.abort(cycle)
+		}
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-r.granted:
+		return r.err
+	case <-ctx.Done():
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// granted (or picked as a deadlock victim) in the meantime.
+	if m.pending[r.txId] != r {
+		return r.err
+	}
+	m.dequeue(r)
+	// requests queued behind this one may be next.
+	m.wake()
+	return fmt.Errorf("%w while waiting for %v", context.Cause(ctx), r.target())
+}
+
+func (r *lockRequest) target() string {
+	if r.r != nil {
+		return fmt.Sprintf("range %v", *r.r)
+	}
+	if r.on > 0 {
+		return fmt.Sprintf("transaction %d", r.on)
+	}
+	return fmt.Sprintf("key %q", r.key)
+}
+
+func (r *lockRequest) keys() []string {
+	if r.r != nil || r.on > 0 {
+		return nil
+	}
+	return []string{r.key}
+}
+
+// the waits-for graph: every waiting transaction points to the transactions it waits for, in ascending order.
+// must be called with m.mu held.
+func (m *lockManager) waitsFor() WaitsForGraph {
+	graph := WaitsForGraph{}
+	for txId, r := range m.pending {
+		blockers := m.blockers(r, true)
+		slices.Sort(blockers)
+		graph[txId] = slices.Compact(blockers)
+	}
+	return graph
+}
+
+// a cycle in graph through txId, if there is one: txId first, then every transaction in it waits for the next one, and the last one for txId.
+func (m *lockManager) cycleThrough(graph WaitsForGraph, txId uint64) []uint64 {
+	visited := map[uint64]bool{}
+
+	var visit func(id uint64, path []uint64) []uint64
+	visit = func(id uint64, path []uint64) []uint64 {
+		if id == txId {
+			return path
+		}
+		if visited[id] {
+			return nil
+		}
+		visited[id] = true
+		for _, next := range graph[id] {
+			if found := visit(next, append(path, id)); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+
+	for _, next := range graph[txId] {
+		if cycle := visit(next, []uint64{txId}); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// abort breaks cycle by failing the request of the victim the policy picks with a deadlock *ConflictError, then grants whatever that unblocks.
+// must be called with m.mu held.
+func (m *lockManager) abort(cycle []uint64) {
+	i := 0
+	for j, id := range cycle {
+		if m.victim.prefer(m, id, cycle[i]) {
+			i = j
+		}
+	}
+	victim := m.pending[cycle[i]]
+	utils.Assert(victim != nil, "deadlock victim isn't waiting")
+	m.dequeue(victim)
+
+	victim.err = &ConflictError{Kind: DeadlockConflict, TxId: victim.txId, OtherTxId: cycle[(i+1)%len(cycle)], Keys: victim.keys()}
+	close(victim.granted)
+
+	// requests queued behind the victim's may be next.
+	m.wake()
+}
+
+// takes the waiting request r out of its queue. must be called with m.mu held.
+func (m *lockManager) dequeue(r *lockRequest) {
+	if r.r == nil && r.on == 0 {
+		l := m.keys[r.key]
+		l.queue = slices.DeleteFunc(l.queue, func(queued *lockRequest) bool { return queued == r })
+		m.forget(r.key)
+	} else {
+		m.waiting = slices.DeleteFunc(m.waiting, func(queued *lockRequest) bool { return queued == r })
+	}
+	delete(m.pending, r.txId)
+}
+
+// detect aborts a victim of every cycle in the waits-for graph, for periodic detection.
+func (m *lockManager) detect() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	aborted := 0
+	for {
+		graph := m.waitsFor()
+		ids := make([]uint64, 0, len(graph))
+		for id := range graph {
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+
+		var cycle []uint64
+		for _, id := range ids {
+			if cycle = m.cycleThrough(graph, id); cycle != nil {
+				break
+			}
+		}
+		if cycle == nil {
+			return aborted
+		}
+		m.abort(cycle)
+		aborted++
+	}
+}
+
+// must be called with m.mu held.
+func (m *lockManager) grant(r *lockRequest) {
+	if r.on > 0 {
+		return
+	}
+	if r.r != nil {
+		m.ranges[r.txId] = append(m.ranges[r.txId], *r.r)
+		return
+	}
+
+	l := m.keys[r.key]
+	if _, ok := l.holders[r.txId]; !ok {
+		m.held[r.txId] = append(m.held[r.txId], r.key)
+	}
+	l.holders[r.txId] = max(l.holders[r.txId], r.mode)
+}
+
+// drops the entry of key once nothing holds or waits for it. must be called with m.mu held.
+func (m *lockManager) forget(key string) {
+	if l, ok := m.keys[key]; ok && len(l.holders) == 0 && len(l.queue) == 0 {
+		delete(m.keys, key)
+	}
+}
+
+// release drops every lock of txId and grants queued requests that became compatible.
+func (m *lockManager) release(txId uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range m.held[txId] {
+		delete(m.keys[key].holders, txId)
+	}
+	delete(m.held, txId)
+	delete(m.ranges, txId)
+	delete(m.running, txId)
+
+	m.wake()
+}
+
+// wake grants every queued request nothing blocks anymore. must be called with m.mu held.
+func (m *lockManager) wake() {
+	// a released range lock can unblock writers of any key in it, so every queue is looked at. Only keys someone waits for are in m.keys
+	// besides the locked ones, that's not many. A request is granted once nothing blocks it, see blockers.
+	for key, l := range m.keys {
+		for granted := true; granted; {
+			granted = false
+			for i, r := range l.queue {
+				if len(m.blockers(r, true)) == 0 {
+					l.queue = slices.Delete(l.queue, i, i+1)
+					delete(m.pending, r.txId)
+					if !r.probe {
+						m.grant(r)
+					}
+					close(r.granted)
+					granted = true
+					break
+				}
+			}
+		}
+		m.forget(key)
+	}
+
+	waiting := m.waiting[:0]
+	for _, r := range m.waiting {
+		if m.compatible(r) {
+			delete(m.pending, r.txId)
+			m.grant(r)
+			close(r.granted)
+		} else {
+			waiting = append(waiting, r)
+		}
+	}
+	clear(m.waiting[len(waiting):])
+	m.waiting = waiting
+}
@@ -0,0 +1,106 @@
+package mvcc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// the recorder writes down everything connections do, the way Jepsen records a history: every command is an invoke event when it starts,
+// and an ok or fail event when it returns. Concurrent commands interleave in the history as they really did.
+// the history is what the checker (see checker.go) works on, it knows nothing about the database beyond what the clients saw.
+
+type EventType uint8
+
+const (
+	InvokeEvent EventType = iota
+	OkEvent
+	FailEvent
+)
+
+func (t EventType) String() string {
+	switch t {
+	case InvokeEvent:
+		return "invoke"
+	case OkEvent:
+		return "ok"
+	case FailEvent:
+		return "fail"
+	}
+	return fmt.Sprintf("EventType(%d)", uint8(t))
+}
+
+type Event struct {
+	// the position of the event in the history.
+	Index int
+	Type  EventType
+	// the connection, numbered from 1 in the order connections were opened.
+	Process int
+	// the transaction the command ran in. Zero when invoking begin, and for commands outside of a transaction.
+	TxId    uint64
+	Command string
+	Args    []string
+
+	// what the command returned, only for ok and fail events.
+	Result string
+	Err    error
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%d %v process=%d tx=%d %s", e.Index, e.Type, e.Process, e.TxId, strings.Join(append([]string{e.Command}, e.Args...), " "))
+	switch e.Type {
+	case OkEvent:
+		s += fmt.Sprintf(" -> %q", e.Result)
+	case FailEvent:
+		s += fmt.Sprintf(" -> %v", e.Err)
+	}
+	return s
+}
+
+// Recorder collects the history of every connection of a database opened WithRecorder. It is safe for concurrent use.
+type Recorder struct {
+	mu        sync.Mutex
+	events    []Event
+	processes int
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// WithRecorder records every command of every connection into r.
+func WithRecorder(r *Recorder) Option {
+	return func(o *options) {
+		o.recorder = r
+	}
+}
+
+// Events returns the history so far, in order.
+func (r *Recorder) Events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+func (r *Recorder) newProcess() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.processes++
+	return r.processes
+}
+
+func (r *Recorder) record(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.Index = len(r.events)
+	r.events = append(r.events, e)
+}
+
+// formats events one per line, like FormatHistory.
+func FormatEvents(events []Event) string {
+	lines := make([]string, len(events))
+	for i, e := range events {
+		lines[i] = e.String()
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,98 @@
+package mvcc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// a serialization failure means the transaction lost a race against a concurrent one, not that it did anything wrong.
+// running it again from the start (against a newer snapshot) will usually succeed, so that's what every caller ends up writing. RunInTransaction writes it once.
+
+// RetryOptions configures RunInTransaction. The zero value retries up to DefaultMaxAttempts times with the default backoff.
+type RetryOptions struct {
+	// every attempt begins a new transaction with these options.
+	TxOptions
+
+	// attempts before giving up, including the first. Zero means DefaultMaxAttempts.
+	MaxAttempts int
+	// wait before the first retry, doubled after every further one up to MaxBackoff. Zero means DefaultBackoff and DefaultMaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// fraction in [0, 1] of each wait that is randomized, so that transactions that conflicted once don't retry in lockstep and conflict again.
+	Jitter float64
+}
+
+const (
+	DefaultMaxAttempts = 10
+	DefaultBackoff     = time.Millisecond
+	DefaultMaxBackoff  = 100 * time.Millisecond
+)
+
+// RunInTransaction runs fn in a transaction and commits it, retrying the whole transaction when it fails with a serialization failure (see ErrSerialization).
+// fn must not commit or roll back tx itself. When fn returns an error the transaction is rolled back and, unless that error is a serialization failure,
+// returned as is without retrying: errors of the caller's own code are never retried.
+//
+// It returns the number of attempts made. When every attempt failed the last serialization failure is returned, and when ctx is done
+// before an attempt could commit or while waiting to retry its error is.
+func (d *Database) RunInTransaction(ctx context.Context, opts RetryOptions, fn func(tx *Tx) error) (int, error) {
+	maxAttempts := opts.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	backoff, maxBackoff := opts.Backoff, opts.MaxBackoff
+	if backoff <= 0 {
+		backoff = DefaultBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = max(backoff, DefaultMaxBackoff)
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return attempt - 1, ctxErr
+		}
+
+		err = d.attempt(ctx, opts.TxOptions, fn)
+		if err == nil || !errors.Is(err, ErrSerialization) {
+			return attempt, err
+		}
+		if attempt == maxAttempts {
+			return attempt, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		wait := backoff
+		if opts.Jitter > 0 {
+			wait -= time.Duration(float64(wait) * min(opts.Jitter, 1) * rand.Float64())
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, ctx.Err()
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// a single try of RunInTransaction. The transaction never outlives it, even when fn panics.
+func (d *Database) attempt(ctx context.Context, opts TxOptions, fn func(tx *Tx) error) error {
+	tx, err := d.BeginContext(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if !tx.finished() {
+			tx.Rollback()
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.CommitContext(ctx)
+}
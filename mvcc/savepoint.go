@@ -0,0 +1,169 @@
+package mvcc
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/mukeshjc/mvcc-isolation/v2/utils"
+)
+
+// savepoints let a transaction roll back part of its work and keep going, like SQL's SAVEPOINT, ROLLBACK TO SAVEPOINT and RELEASE SAVEPOINT.
+//
+// every set and delete does two things to a version chain: it marks the versions it could see with its txEndId, and a set appends a new version.
+// once a savepoint exists each write also remembers what it did in an undo log. Rolling back to the savepoint walks the log backwards
+// and reverts every write done since: the appended version is removed again, and the marks on the versions it ended are taken off again.
+// a transaction without savepoints pays nothing for this.
+//
+// the reads done since the savepoint stay recorded. Under SerializableSnapshotIsolation so do the rw-antidependencies of the undone writes,
+// which can only make the transaction abort more often than needed, never less.
+
+// what a single set or delete did, enough to undo it.
+type undoEntry struct {
+	key string
+	// a set appended a version, a delete didn't.
+	appended bool
+	// the creators of the versions the write marked with its txEndId, like walRecord.ends.
+	ends []uint64
+	// the write put key in the writeset, undoing it takes it out again so the transaction no longer conflicts on key.
+	newInWriteset bool
+}
+
+type savepoint struct {
+	name string
+	// the length of the undo log when the savepoint was taken.
+	undo int
+}
+
+// Savepoint marks the current state of the transaction, RollbackTo can later return to it.
+// Savepoints may share a name, the newest one with a name is the one it refers to.
+func (tx *Tx) Savepoint(name string) error {
+	return tx.SavepointContext(context.Background(), name)
+}
+
+func (tx *Tx) SavepointContext(ctx context.Context, name string) error {
+	if err := tx.enterContext(ctx); err != nil {
+		return err
+	}
+	defer tx.exit()
+
+	tx.savepoints = append(tx.savepoints, savepoint{name: name, undo: len(tx.undo)})
+	return nil
+}
+
+// RollbackTo undoes every set and delete since the savepoint named name. The savepoint itself remains and can be rolled back to again,
+// savepoints taken after it are gone.
+func (tx *Tx) RollbackTo(name string) error {
+	return tx.RollbackToContext(context.Background(), name)
+}
+
+// RollbackToContext is RollbackTo, unless ctx is done before it starts. Once started every write since the savepoint is undone.
+func (tx *Tx) RollbackToContext(ctx context.Context, name string) error {
+	if err := tx.enterContext(ctx); err != nil {
+		return err
+	}
+	defer tx.exit()
+
+	i, err := tx.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+
+	sp := tx.savepoints[i]
+	for j := len(tx.undo) - 1; j >= sp.undo; j-- {
+		if err := tx.undoWrite(tx.undo[j]); err != nil {
+			// the writes after j are still undone in the log and in memory, the transaction is consistent up to there.
+			clear(tx.undo[j+1:])
+			tx.undo = tx.undo[:j+1]
+			return err
+		}
+	}
+	clear(tx.undo[sp.undo:])
+	tx.undo = tx.undo[:sp.undo]
+	tx.savepoints = tx.savepoints[:i+1]
+	return nil
+}
+
+// Release forgets the savepoint named name and every savepoint taken after it, keeping all the work done since.
+func (tx *Tx) Release(name string) error {
+	return tx.ReleaseContext(context.Background(), name)
+}
+
+func (tx *Tx) ReleaseContext(ctx context.Context, name string) error {
+	if err := tx.enterContext(ctx); err != nil {
+		return err
+	}
+	defer tx.exit()
+
+	i, err := tx.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+
+	tx.savepoints = tx.savepoints[:i]
+	// nothing can roll back past the remaining savepoints.
+	if len(tx.savepoints) == 0 {
+		tx.undo = nil
+	}
+	return nil
+}
+
+func (tx *Tx) findSavepoint(name string) (int, error) {
+	for i := len(tx.savepoints) - 1; i > -1; i-- {
+		if tx.savepoints[i].name == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%w %q", ErrNoSavepoint, name)
+}
+
+func (tx *Tx) undoWrite(u undoEntry) error {
+	// a version this transaction created keeps its chain, but one it only marked may be gone: under read uncommitted it can mark an uncommitted
+	// version that vacuum removes once its creator rolled back, the chain with it. Then there is nothing left to revert, the log still gets
+	// the record, replay has the chain.
+	chain := tx.db.lockChain(u.key, false)
+	if chain != nil {
+		defer chain.mu.Unlock()
+	}
+
+	if err := tx.db.wal.append(walRecord{typ: walUndo, txId: tx.t.id, key: u.key, appended: u.appended, ends: u.ends}); err != nil {
+		return err
+	}
+	if chain != nil {
+		undoWrite(chain, tx.t.id, u.appended, u.ends)
+	}
+
+	if u.newInWriteset {
+		tx.t.writeset.Delete(u.key)
+	}
+	return nil
+}
+
+// reverts a set or delete of transaction txId on chain. must be called with the chain locked (or during replay).
+func undoWrite(chain *versionChain, txId uint64, appended bool, ends []uint64) {
+	// later writes of the same transaction were undone already, so the version this write appended is the newest one the transaction created.
+	if appended {
+		i := newestVersionBy(chain, txId)
+		utils.Assert(i > -1, "undo of a set without its version")
+		chain.versions = slices.Delete(chain.versions, i, i+1)
+	}
+
+	for _, creator := range ends {
+		// another transaction may have marked the version since, its mark stays.
+		if i := newestVersionBy(chain, creator); i > -1 {
+			chain.versions[i].unmark(func(id uint64) bool { return id == txId })
+		}
+	}
+}
+
+// the index of the newest version in chain created by txId, or -1.
+// a transaction can see at most one version per creating transaction, the newest one, so this finds the version a write marked
+// without depending on positions in the chain, which vacuum shifts.
+func newestVersionBy(chain *versionChain, txId uint64) int {
+	for i := len(chain.versions) - 1; i > -1; i-- {
+		if chain.versions[i].txStartId == txId {
+			return i
+		}
+	}
+	return -1
+}
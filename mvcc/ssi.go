@@ -0,0 +1,235 @@
+package mvcc
+
+import (
+	"sync"
+
+	"github.com/tidwall/btree"
+)
+
+// Serializable Snapshot Isolation (Cahill, Röhm, Fekete 2008), the way Postgres implements SERIALIZABLE.
+// https://courses.cs.washington.edu/courses/cse444/08au/544M/READING-LIST/fekete-sigmod2008.pdf
+//
+// SerializableIsolation aborts a transaction as soon as its reads or writes overlap the writes of any concurrent committed transaction.
+// That is safe but aborts plenty of histories that are perfectly serializable, e.g. T1 reads x, T2 writes x: just order T1 before T2.
+//
+// Every non-serializable execution under snapshot isolation contains a "dangerous structure": two consecutive rw-antidependencies between concurrent transactions
+//
+//	T_in -rw-> T_pivot -rw-> T_out
+//
+// where T1 -rw-> T2 means T1 read a version of some key that T2 (concurrent with T1) overwrote, so T1 must come before T2 in any serial order.
+// T_in and T_out may be the same transaction, which is the classic write skew.
+// Postgres further refines this: the structure can only produce a cycle if T_out commits first, so we only abort when that happened.
+//
+// the tracker keeps:
+//   - SIREAD locks: for every key, the transactions that read it. They outlive the commit of the reader, a later concurrent writer still needs to find them.
+//     scans also lock the range they read, so that inserts into it (phantoms) are found as well.
+//   - for every transaction its incoming and outgoing rw-antidependencies, and the order in which transactions committed.
+//
+// Only transactions running at SerializableSnapshotIsolation take part. Vacuum drops everything about transactions that committed before
+// every running transaction began, those aren't concurrent with anything running anymore so no new edge can touch them.
+
+type ssiTracker struct {
+	mu sync.Mutex
+
+	readers map[string]*btree.Set[uint64]
+	// predicate locks: SIREAD locks on ranges of keys taken by scans.
+	rangeReaders []ssiRangeRead
+	txs          map[uint64]*ssiTransaction
+}
+
+type ssiRangeRead struct {
+	id uint64
+	r  keyRange
+}
+
+type ssiTransaction struct {
+	in  btree.Set[uint64]
+	out btree.Set[uint64]
+
+	// the commit timestamp, zero until committed. Gives the commit order.
+	commitTs uint64
+	aborted  bool
+}
+
+func newSSITracker() *ssiTracker {
+	return &ssiTracker{
+		readers: map[string]*btree.Set[uint64]{},
+		txs:     map[uint64]*ssiTransaction{},
+	}
+}
+
+// whether other ran concurrently with the running transaction t: it didn't commit before t began.
+// transactions that aren't tracked (any more) never get an edge anyway. must be called with s.mu held.
+func (s *ssiTracker) concurrent(t *Transaction, other uint64) bool {
+	o, ok := s.txs[other]
+	return ok && other != t.id && (o.commitTs == 0 || o.commitTs > t.startTs)
+}
+
+func (s *ssiTracker) register(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.txs[id] = &ssiTransaction{}
+}
+
+// must be called with s.mu held.
+func (s *ssiTracker) addEdge(from uint64, to uint64) {
+	tFrom, tTo := s.txs[from], s.txs[to]
+	if tFrom == nil || tTo == nil || tFrom.aborted || tTo.aborted {
+		return
+	}
+	tFrom.out.Insert(to)
+	tTo.in.Insert(from)
+}
+
+// read records a SIREAD lock of t on key, and an rw-antidependency from t to every concurrent transaction that wrote a version of key.
+// t can't see those versions, so it read "before" them. must be called with the chain of key locked.
+func (s *ssiTracker) read(t *Transaction, key string, versions []Value) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	readers, ok := s.readers[key]
+	if !ok {
+		readers = &btree.Set[uint64]{}
+		s.readers[key] = readers
+	}
+	readers.Insert(t.id)
+
+	for _, value := range versions {
+		if s.concurrent(t, value.txStartId) {
+			s.addEdge(t.id, value.txStartId)
+		}
+		if value.txEndId > 0 && s.concurrent(t, value.txEndId) {
+			s.addEdge(t.id, value.txEndId)
+		}
+	}
+}
+
+// readRange records a SIREAD lock of t on a range of keys. The keys that exist in it are read one by one afterwards,
+// this only has to catch the ones inserted later.
+func (s *ssiTracker) readRange(t *Transaction, r keyRange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rangeReaders = append(s.rangeReaders, ssiRangeRead{id: t.id, r: r})
+}
+
+// write records an rw-antidependency to t from every concurrent transaction that read key, or a range containing key.
+// must be called with the chain of key locked.
+func (s *ssiTracker) write(t *Transaction, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if readers, ok := s.readers[key]; ok {
+		iter := readers.Iter()
+		for ok := iter.First(); ok; ok = iter.Next() {
+			if s.concurrent(t, iter.Key()) {
+				s.addEdge(iter.Key(), t.id)
+			}
+		}
+	}
+
+	for _, rr := range s.rangeReaders {
+		if rr.r.contains(key) && s.concurrent(t, rr.id) {
+			s.addEdge(rr.id, t.id)
+		}
+	}
+}
+
+// commit marks t committed at commitTs, unless that would complete a dangerous structure in which case t is marked aborted
+// and false is returned along with the committed transaction that closed the structure.
+func (s *ssiTracker) commit(id uint64, commitTs uint64) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.txs[id]
+	if other, ok := s.dangerous(t); ok {
+		t.aborted = true
+		return other, false
+	}
+
+	t.commitTs = commitTs
+	return 0, true
+}
+
+func (s *ssiTracker) abort(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.txs[id]; ok {
+		t.commitTs = 0
+		t.aborted = true
+	}
+}
+
+// must be called with s.mu held.
+func (s *ssiTracker) dangerous(t *ssiTransaction) (uint64, bool) {
+	// t as the pivot: someone depends on t reading before them, and the transaction t read before already committed.
+	outIter := t.out.Iter()
+	for ok := outIter.First(); ok; ok = outIter.Next() {
+		tOut := s.txs[outIter.Key()]
+		if tOut == nil || tOut.commitTs == 0 {
+			continue
+		}
+		inIter := t.in.Iter()
+		for ok := inIter.First(); ok; ok = inIter.Next() {
+			tIn := s.txs[inIter.Key()]
+			if tIn == nil || tIn.aborted {
+				continue
+			}
+			// T_out committed first, unless T_in committed before it.
+			if tIn.commitTs == 0 || tIn.commitTs >= tOut.commitTs {
+				return outIter.Key(), true
+			}
+		}
+	}
+
+	// t as T_in: the pivot already committed, after its own T_out.
+	pivotIter := t.out.Iter()
+	for ok := pivotIter.First(); ok; ok = pivotIter.Next() {
+		pivot := s.txs[pivotIter.Key()]
+		if pivot == nil || pivot.commitTs == 0 {
+			continue
+		}
+		outIter := pivot.out.Iter()
+		for ok := outIter.First(); ok; ok = outIter.Next() {
+			tOut := s.txs[outIter.Key()]
+			if tOut != nil && tOut.commitTs != 0 && tOut.commitTs < pivot.commitTs {
+				return pivotIter.Key(), true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// drops SIREAD locks and dependencies of aborted transactions, and of those that committed at or before the vacuum's snapshot horizon.
+func (s *ssiTracker) prune(horizon uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, t := range s.txs {
+		if t.aborted || (t.commitTs != 0 && t.commitTs <= horizon) {
+			delete(s.txs, id)
+		}
+	}
+	for key, readers := range s.readers {
+		for _, id := range readers.Keys() {
+			if _, ok := s.txs[id]; !ok {
+				readers.Delete(id)
+			}
+		}
+		if readers.Len() == 0 {
+			delete(s.readers, key)
+		}
+	}
+
+	rangeReaders := s.rangeReaders[:0]
+	for _, rr := range s.rangeReaders {
+		if _, ok := s.txs[rr.id]; ok {
+			rangeReaders = append(rangeReaders, rr)
+		}
+	}
+	clear(s.rangeReaders[len(rangeReaders):])
+	s.rangeReaders = rangeReaders
+}
@@ -1,6 +1,9 @@
 package mvcc
 
 import (
+	"fmt"
+	"sync/atomic"
+
 	"github.com/tidwall/btree"
 )
 
@@ -13,19 +16,43 @@ const (
 	CommittedTransaction
 )
 
+func (s TransactionState) String() string {
+	switch s {
+	case InProgressTransaction:
+		return "in-progress"
+	case RolledBackTransaction:
+		return "rolled-back"
+	case CommittedTransaction:
+		return "committed"
+	}
+	return fmt.Sprintf("TransactionState(%d)", uint8(s))
+}
+
 // transaction has an isolation level, an id (monotonic increasing integer), and a current state.
 // And although we won't make use of this data yet, transactions at stricter isolation levels will need some extra info.
-// Specifically, stricter isolation levels need to know about other transactions that were in-progress when this one started.
+// Specifically, stricter isolation levels need to know which transactions committed before this one started: its snapshot.
 // And stricter isolation levels need to know about all keys read and written by a transaction.
 type Transaction struct {
 	isolation IsolationLevel
 	id        uint64
 	state     TransactionState
 
-	// Used only by Repeatable Read and stricter.
-	inprogress btree.Set[uint64]
+	// commit timestamps, in the style of Percolator: every commit gets the next timestamp, and a transaction's snapshot is the last commit
+	// timestamp when it began. It sees exactly the transactions that committed at or before startTs, no matter their ids.
+	// two transactions are concurrent when neither committed before the other began. Used only by Repeatable Read and stricter.
+	startTs uint64
+	// zero unless committed.
+	commitTs uint64
 
 	// Used only by Snapshot Isolation and stricter.
 	writeset btree.Set[string]
 	readset  btree.Set[string]
+	// ranges read by scan and prefix.
+	rangeReads []keyRange
+
+	// for read-only time-travel transactions: the transaction whose snapshot (startTs) it reads, and whose writes it sees too. Zero otherwise.
+	asOf uint64
+
+	// the number of sets and deletes so far, shared with the lock manager which picks deadlock victims by it.
+	work *atomic.Int64
 }
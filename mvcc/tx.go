@@ -0,0 +1,599 @@
+package mvcc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mukeshjc/mvcc-isolation/v2/utils"
+)
+
+// Tx is the Go API to a transaction. Connection.ExecCommand is a thin string interface on top of it.
+// A goroutine can hold any number of open transactions at once, but a single Tx is not safe for concurrent use.
+//
+// every call that may wait for another transaction has a variant taking a context, like database/sql: when the context is done while
+// waiting the call gives up with the context's error, and the transaction keeps going.
+type Tx struct {
+	db *Database
+	t  *Transaction
+
+	// held for the whole of every call. Only the idle timeout ever contends for it, it ends the transaction from its own goroutine.
+	mu sync.Mutex
+
+	// set once the transaction committed or rolled back, every later call fails with ErrTransactionDone.
+	done bool
+	// why the transaction ended, when that wasn't a call on it (see TxOptions.IdleTimeout). Every later call fails with it instead.
+	err error
+
+	// see savepoint.go. The undo log is only kept while there are savepoints.
+	savepoints []savepoint
+	undo       []undoEntry
+
+	noWait bool
+
+	statementTimeout time.Duration
+	idleTimeout      time.Duration
+	// the calls made so far and the idle timer set after the last one. The timer only ends the transaction if no call started since.
+	calls uint64
+	idle  *time.Timer
+}
+
+type TxOptions struct {
+	// nil runs the transaction at the database's default level. A pointer because every IsolationLevel value, zero included, is a level.
+	Isolation *IsolationLevel
+
+	// a non-zero AsOf makes a read-only time-travel transaction: it reads the database as the transaction with id AsOf saw it, plus that
+	// transaction's own writes if it committed. The version chains keep the whole history until vacuum removes it, so this works until a
+	// vacuum's horizon moves past that snapshot (ErrSnapshotTooOld). Isolation is ignored, a snapshot of the past is always repeatable read.
+	// The transaction AsOf must have ended, until then it isn't known whether its writes belong to the snapshot (ErrUnknownTransaction).
+	AsOf uint64
+
+	// NoWait makes everything that would wait for a lock held by another transaction fail with ErrLockNotAvailable instead. See GetForUpdate.
+	NoWait bool
+
+	// StatementTimeout bounds every single call, like Postgres' statement_timeout: a call still waiting for a lock when it runs out fails with
+	// ErrStatementTimeout, the transaction keeps going. Zero waits as long as the call's context allows.
+	StatementTimeout time.Duration
+
+	// IdleTimeout rolls the transaction back once no call was made on it for that long, like Postgres' idle_in_transaction_session_timeout.
+	// A transaction someone forgot to end would otherwise hold back vacuum (and keep its locks) forever. Every later call fails with
+	// ErrIdleInTransactionTimeout. Zero never times out.
+	IdleTimeout time.Duration
+}
+
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Begin starts a new transaction.
+func (d *Database) Begin(opts TxOptions) (*Tx, error) {
+	return d.BeginContext(context.Background(), opts)
+}
+
+// BeginContext is Begin failing with the cause of ctx when ctx is done before the transaction began. Beginning never waits for other
+// transactions, so that's the only time ctx is looked at. The same goes for the other calls on a Tx that can't wait, like CommitContext.
+func (d *Database) BeginContext(ctx context.Context, opts TxOptions) (*Tx, error) {
+	if ctx.Err() != nil {
+		return nil, context.Cause(ctx)
+	}
+
+	isolation := d.defaultIsolation
+	if opts.Isolation != nil {
+		isolation = *opts.Isolation
+	}
+
+	t, err := d.newTransaction(isolation, opts.AsOf)
+	if err != nil {
+		return nil, err
+	}
+	d.assertValidTransaction(t)
+
+	tx := &Tx{db: d, t: t, noWait: opts.NoWait, statementTimeout: opts.StatementTimeout, idleTimeout: opts.IdleTimeout}
+	// the idle timer runs from the start.
+	tx.mu.Lock()
+	tx.exit()
+	return tx, nil
+}
+
+func (tx *Tx) ID() uint64 {
+	return tx.t.id
+}
+
+func (tx *Tx) Isolation() IsolationLevel {
+	return tx.t.isolation
+}
+
+// AsOf returns the transaction id a time-travel transaction reads as of, zero for regular ones.
+func (tx *Tx) AsOf() uint64 {
+	return tx.t.asOf
+}
+
+func (tx *Tx) check() error {
+	if tx.done {
+		if tx.err != nil {
+			return tx.err
+		}
+		return ErrTransactionDone
+	}
+	tx.db.assertValidTransaction(tx.t)
+	return nil
+}
+
+// enter starts a call on the transaction, exit ends it. In between the transaction is locked and the idle timer stopped.
+func (tx *Tx) enter() error {
+	tx.mu.Lock()
+	if err := tx.check(); err != nil {
+		tx.mu.Unlock()
+		return err
+	}
+
+	tx.calls++
+	if tx.idle != nil {
+		tx.idle.Stop()
+	}
+	return nil
+}
+
+func (tx *Tx) exit() {
+	if tx.idleTimeout > 0 && !tx.done {
+		calls := tx.calls
+		tx.idle = time.AfterFunc(tx.idleTimeout, func() { tx.expire(calls) })
+	}
+	tx.mu.Unlock()
+}
+
+// enterContext is enter for calls that can't wait: they fail with the cause of ctx when it is done before they start, and once started they
+// run to the end.
+func (tx *Tx) enterContext(ctx context.Context) error {
+	if err := tx.enter(); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		tx.exit()
+		return context.Cause(ctx)
+	}
+	return nil
+}
+
+// statement is enter for calls that may wait, it also applies the statement timeout to ctx. Calling the returned function ends the call.
+func (tx *Tx) statement(ctx context.Context) (context.Context, func(), error) {
+	if err := tx.enterContext(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	cancel := func() {}
+	if tx.statementTimeout > 0 {
+		ctx, cancel = context.WithTimeoutCause(ctx, tx.statementTimeout, fmt.Errorf("%w: %w", ErrStatementTimeout, context.DeadlineExceeded))
+	}
+	return ctx, func() {
+		cancel()
+		tx.exit()
+	}, nil
+}
+
+// the idle timer ran out. Unless a call started since it was set, the transaction is rolled back.
+func (tx *Tx) expire(calls uint64) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done || tx.calls != calls {
+		return
+	}
+	tx.done = true
+	tx.err = ErrIdleInTransactionTimeout
+	if err := tx.db.completeTransaction(tx.t, RolledBackTransaction); err != nil {
+		tx.err = fmt.Errorf("%w, then rolling back failed: %w", ErrIdleInTransactionTimeout, err)
+	}
+}
+
+// whether the transaction is over, also when it didn't end by a call on it.
+func (tx *Tx) finished() bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.done
+}
+
+// neat thing about MVCC is that committing, and rollingback a transaction is metadata work.
+// it will not involve modifying any values we get, set, or delete.
+// we call the completeTransaction method (which makes sure the database transaction history gets updated) with the CommittedTransaction/RolledBackTransaction state.
+
+// Commit commits the transaction. If it fails with a serialization failure (see ErrSerialization) the transaction was rolled back instead.
+// Either way the transaction is over.
+func (tx *Tx) Commit() error {
+	return tx.CommitContext(context.Background())
+}
+
+// CommitContext is Commit, unless ctx is done before the commit starts: then it fails with the cause of ctx and the transaction keeps going.
+// A commit that started isn't given up halfway, writing it to the log included.
+func (tx *Tx) CommitContext(ctx context.Context) error {
+	if err := tx.enterContext(ctx); err != nil {
+		return err
+	}
+	defer tx.exit()
+
+	tx.done = true
+	return tx.db.completeTransaction(tx.t, CommittedTransaction)
+}
+
+// Rollback takes no context: giving up on a transaction has to work also once the caller's context is done.
+func (tx *Tx) Rollback() error {
+	if err := tx.enter(); err != nil {
+		return err
+	}
+	defer tx.exit()
+
+	tx.done = true
+	return tx.db.completeTransaction(tx.t, RolledBackTransaction)
+}
+
+// "get" support, we'll iterate the list of value versions backwards for the key. And we'll call a special "isvisible" method to determine if this transaction can see this value.
+// The first value that passes the isvisible test is the correct value for the transaction.
+func (tx *Tx) Get(key string) (string, error) {
+	return tx.GetContext(context.Background(), key)
+}
+
+func (tx *Tx) GetContext(ctx context.Context, key string) (string, error) {
+	ctx, end, err := tx.statement(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer end()
+
+	return tx.get(ctx, key)
+}
+
+func (tx *Tx) get(ctx context.Context, key string) (string, error) {
+	if tx.t.isolation == TwoPhaseLockingSerializableIsolation {
+		if err := tx.lock(ctx, key, SharedLock, false, false); err != nil {
+			return "", err
+		}
+	}
+
+	// serializable snapshot isolation has to remember reads of missing keys too, a concurrent insert is an rw-antidependency just the same.
+	// creating the (empty) chain makes that read and the insert serialize on the chain lock.
+	if chain := tx.db.chain(key, tx.t.isolation == SerializableSnapshotIsolation); chain != nil {
+		if value, ok := tx.readChain(key, chain); ok {
+			return value, nil
+		}
+	} else {
+		// useful for stricter isolation levels
+		tx.t.readset.Insert(key)
+	}
+
+	return "", &NotFoundError{Command: "get", Key: key}
+}
+
+// Scan returns every key (and its value) visible to the transaction in the range [start, end), in ascending order of keys.
+// An empty end scans to the last key. Each key found is read exactly like Get reads it.
+func (tx *Tx) Scan(start string, end string) ([]KeyValue, error) {
+	return tx.ScanContext(context.Background(), start, end)
+}
+
+func (tx *Tx) ScanContext(ctx context.Context, start string, end string) ([]KeyValue, error) {
+	return tx.scan(ctx, keyRange{start: start, end: end})
+}
+
+// Prefix returns every key (and its value) visible to the transaction that starts with prefix, in ascending order of keys.
+func (tx *Tx) Prefix(prefix string) ([]KeyValue, error) {
+	return tx.PrefixContext(context.Background(), prefix)
+}
+
+func (tx *Tx) PrefixContext(ctx context.Context, prefix string) ([]KeyValue, error) {
+	return tx.scan(ctx, prefixRange(prefix))
+}
+
+func (tx *Tx) scan(ctx context.Context, r keyRange) ([]KeyValue, error) {
+	ctx, end, err := tx.statement(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	if tx.t.isolation == TwoPhaseLockingSerializableIsolation {
+		if err := tx.failed(tx.db.locks.acquireRange(ctx, tx.t.id, r, !tx.noWait)); err != nil {
+			return nil, err
+		}
+	}
+
+	// useful for stricter isolation levels, the range has to be recorded before looking at the keys in it.
+	// otherwise a concurrent serializable snapshot insert could slip in between without either side noticing the other.
+	tx.t.rangeReads = append(tx.t.rangeReads, r)
+	if tx.t.isolation == SerializableSnapshotIsolation {
+		tx.db.ssi.readRange(tx.t, r)
+	}
+
+	var kvs []KeyValue
+	for _, kc := range tx.db.chainsFrom(r.start, func(key string) bool { return !r.contains(key) }) {
+		if value, ok := tx.readChain(kc.key, kc.chain); ok {
+			kvs = append(kvs, KeyValue{Key: kc.key, Value: value})
+		}
+	}
+	return kvs, nil
+}
+
+// reads the value of key visible to the transaction, recording the read for the stricter isolation levels.
+func (tx *Tx) readChain(key string, chain *versionChain) (string, bool) {
+	chain.mu.RLock()
+	// vacuum may have removed the chain since it was looked up, and a concurrent writer put the key's next one in its place. Reading the
+	// removed one would miss that writer's versions, and under serializable snapshot isolation the rw-antidependency to it.
+	if chain.removed {
+		chain.mu.RUnlock()
+		if chain = tx.db.rlockChain(key, tx.t.isolation == SerializableSnapshotIsolation); chain == nil {
+			tx.t.readset.Insert(key)
+			return "", false
+		}
+	}
+	defer chain.mu.RUnlock()
+
+	// useful for stricter isolation levels
+	tx.t.readset.Insert(key)
+	if tx.t.isolation == SerializableSnapshotIsolation {
+		tx.db.ssi.read(tx.t, key, chain.versions)
+	}
+	return tx.db.visibleValue(tx.t, chain)
+}
+
+func (tx *Tx) Set(key string, value string) error {
+	return tx.SetContext(context.Background(), key, value)
+}
+
+func (tx *Tx) SetContext(ctx context.Context, key string, value string) error {
+	return tx.write(ctx, key, &value)
+}
+
+func (tx *Tx) Delete(key string) error {
+	return tx.DeleteContext(context.Background(), key)
+}
+
+func (tx *Tx) DeleteContext(ctx context.Context, key string) error {
+	return tx.write(ctx, key, nil)
+}
+
+// set and delete are similar to get. But this time when we walk the list of value versions, we will set the txEndId for the value to the current transaction id if the value version is visible to this transaction.
+// a nil value deletes the key.
+func (tx *Tx) write(ctx context.Context, key string, value *string) error {
+	ctx, end, err := tx.statement(ctx)
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	// writing into the past would rewrite history other transactions already read.
+	if tx.t.asOf > 0 {
+		return ErrReadOnlyTransaction
+	}
+
+	// plain writes don't lock (except under two-phase locking), but they wait for the locks others took on the key.
+	if err := tx.lock(ctx, key, ExclusiveLock, tx.t.isolation != TwoPhaseLockingSerializableIsolation, false); err != nil {
+		return err
+	}
+
+	// a delete of a missing key reads that the key is missing, serializable snapshot isolation needs the chain to remember that like get does.
+	chain, err := tx.lockChainForWrite(ctx, key, value != nil || tx.t.isolation == SerializableSnapshotIsolation)
+	if err != nil {
+		return err
+	}
+	if chain == nil {
+		// useful for stricter isolation levels
+		tx.t.readset.Insert(key)
+		return &NotFoundError{Command: "delete", Key: key}
+	}
+	defer chain.mu.Unlock()
+
+	// find all visible versions, these are the ones this write will mark as now invalid.
+	var visible []int
+	for i := len(chain.versions) - 1; i > -1; i-- {
+		version := chain.versions[i]
+		utils.Debug(version, tx.t, tx.db.isVisible(tx.t, version))
+		if tx.db.isVisible(tx.t, version) {
+			visible = append(visible, i)
+		}
+	}
+
+	// the transaction saw the key doesn't exist, a concurrent insert of it is a conflict just as for a get.
+	if value == nil && len(visible) == 0 {
+		tx.t.readset.Insert(key)
+		if tx.t.isolation == SerializableSnapshotIsolation {
+			tx.db.ssi.read(tx.t, key, chain.versions)
+		}
+		return &NotFoundError{Command: "delete", Key: key}
+	}
+
+	// the write must be in the log before it is applied.
+	record := walRecord{typ: walDelete, txId: tx.t.id, key: key}
+	if value != nil {
+		record.typ = walSet
+		record.value = *value
+	}
+	for _, i := range visible {
+		record.ends = append(record.ends, chain.versions[i].txStartId)
+	}
+	if err := tx.db.wal.append(record); err != nil {
+		return err
+	}
+
+	for _, i := range visible {
+		chain.versions[i].mark(tx.t.id)
+	}
+	tx.db.writesSinceVacuum.Add(1)
+	tx.t.work.Add(1)
+
+	if len(tx.savepoints) > 0 {
+		tx.undo = append(tx.undo, undoEntry{
+			key:           key,
+			appended:      value != nil,
+			ends:          record.ends,
+			newInWriteset: !tx.t.writeset.Contains(key),
+		})
+	}
+
+	// useful for stricter isolation levels
+	tx.t.writeset.Insert(key)
+
+	if tx.t.isolation == SerializableSnapshotIsolation {
+		tx.db.ssi.write(tx.t, key)
+	}
+
+	// for set, we'll append to the value version list with the new version of the value that starts at this current transaction.
+	if value != nil {
+		chain.versions = append(chain.versions, Value{
+			txStartId: tx.t.id,
+			txEndId:   0,
+			value:     *value,
+		})
+	}
+
+	return nil
+}
+
+// lockChain for a set or delete. With blocking writes it first waits until no other transaction has an uncommitted write to key.
+// Under a first-updater-wins policy it fails with a *ConflictError when a concurrent transaction wrote key, see WriteConflictPolicy.
+func (tx *Tx) lockChainForWrite(ctx context.Context, key string, create bool) (*versionChain, error) {
+	firstUpdater := tx.db.writeConflicts != FirstCommitterWins && tx.t.isolation.forbidsWriteConflicts()
+
+	for {
+		chain := tx.db.lockChain(key, create)
+		if chain == nil {
+			return nil, nil
+		}
+
+		var other uint64
+		if firstUpdater {
+			writer, committed := tx.concurrentWriter(chain)
+			if committed || (writer > 0 && tx.db.writeConflicts == FirstUpdaterWinsFail) {
+				chain.mu.Unlock()
+				return nil, tx.failed(&ConflictError{Kind: WriteWriteConflict, TxId: tx.t.id, OtherTxId: writer, Keys: []string{key}})
+			}
+			other = writer
+		}
+		if other == 0 && tx.db.blockingWrites {
+			other = tx.db.uncommittedWriter(tx.t.id, chain)
+		}
+		if other == 0 {
+			return chain, nil
+		}
+
+		// once other is done, someone else may have written key in the meantime: look again.
+		chain.mu.Unlock()
+		if err := tx.failed(tx.db.locks.waitFor(ctx, tx.t.id, other, !tx.noWait)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// a transaction that wrote a version of chain (or ended one) and is concurrent to this one: still in progress, or committed after the snapshot.
+// A committed one wins over one in progress. must be called with the chain locked.
+func (tx *Tx) concurrentWriter(chain *versionChain) (uint64, bool) {
+	var inProgress uint64
+	for _, value := range chain.versions {
+		for _, id := range append([]uint64{value.txStartId, value.txEndId}, value.priorEnds...) {
+			if id == 0 || id == tx.t.id {
+				continue
+			}
+			switch tx.db.transactionState(id).state {
+			case CommittedTransaction:
+				if !tx.db.inSnapshot(tx.t, id) {
+					return id, true
+				}
+			case InProgressTransaction:
+				inProgress = id
+			}
+		}
+	}
+	return inProgress, false
+}
+
+// GetForUpdate is SELECT ... FOR UPDATE: it locks key exclusively until the transaction commits or rolls back, then reads it like Get.
+// Other transactions calling GetForUpdate on the key, or writing it, wait for the lock. Plain writes don't hold the lock, so GetForUpdate
+// also waits for a transaction with an uncommitted write to key to end first. With nowait (or TxOptions.NoWait) it fails with
+// ErrLockNotAvailable instead of waiting.
+//
+// under read committed the read returns the latest committed version, so a read-modify-write of a hot counter through GetForUpdate never loses
+// an update and never conflicts. Repeatable read and stricter read their snapshot, which may be older than the version just locked: when another
+// transaction committed a write to key after the snapshot was taken the transaction is rolled back with a *ConflictError right away,
+// like Postgres does, instead of going on with a value that is already out of date.
+func (tx *Tx) GetForUpdate(key string, nowait bool) (string, error) {
+	return tx.GetForUpdateContext(context.Background(), key, nowait)
+}
+
+func (tx *Tx) GetForUpdateContext(ctx context.Context, key string, nowait bool) (string, error) {
+	ctx, end, err := tx.statement(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer end()
+
+	if tx.t.asOf > 0 {
+		return "", ErrReadOnlyTransaction
+	}
+
+	if err := tx.lock(ctx, key, ExclusiveLock, false, nowait); err != nil {
+		return "", err
+	}
+	if err := tx.waitForUncommittedWriters(ctx, key, nowait); err != nil {
+		return "", err
+	}
+
+	switch tx.t.isolation {
+	case ReadUncommittedIsolation, ReadCommittedIsolation, TwoPhaseLockingSerializableIsolation:
+	default:
+		if other, ok := tx.updatedSinceSnapshot(key); ok {
+			return "", tx.failed(&ConflictError{Kind: WriteWriteConflict, TxId: tx.t.id, OtherTxId: other, Keys: []string{key}})
+		}
+	}
+
+	return tx.get(ctx, key)
+}
+
+// waits until no other transaction has an uncommitted write to key. The lock on key keeps new plain writes out meanwhile, they probe it.
+func (tx *Tx) waitForUncommittedWriters(ctx context.Context, key string, nowait bool) error {
+	for {
+		chain := tx.db.rlockChain(key, false)
+		if chain == nil {
+			return nil
+		}
+		other := tx.db.uncommittedWriter(tx.t.id, chain)
+		chain.mu.RUnlock()
+		if other == 0 {
+			return nil
+		}
+		if err := tx.failed(tx.db.locks.waitFor(ctx, tx.t.id, other, !nowait && !tx.noWait)); err != nil {
+			return err
+		}
+	}
+}
+
+// lock takes a lock on key (or, for a probe, waits until it could), see lockManager.acquire.
+func (tx *Tx) lock(ctx context.Context, key string, mode LockMode, probe bool, nowait bool) error {
+	return tx.failed(tx.db.locks.acquire(ctx, tx.t.id, key, mode, !nowait && !tx.noWait, probe))
+}
+
+// failed rolls the transaction back when err is a serialization failure found before commit, like a deadlock. Other errors leave it running.
+func (tx *Tx) failed(err error) error {
+	if err == nil || !errors.Is(err, ErrSerialization) {
+		return err
+	}
+
+	tx.done = true
+	if rollbackErr := tx.db.completeTransaction(tx.t, RolledBackTransaction); rollbackErr != nil {
+		return rollbackErr
+	}
+	return err
+}
+
+// returns a transaction outside of the snapshot that committed a version of key, or ended one.
+func (tx *Tx) updatedSinceSnapshot(key string) (uint64, bool) {
+	chain := tx.db.rlockChain(key, false)
+	if chain == nil {
+		return 0, false
+	}
+	defer chain.mu.RUnlock()
+
+	if other, committed := tx.concurrentWriter(chain); committed {
+		return other, true
+	}
+	return 0, false
+}
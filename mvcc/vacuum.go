@@ -0,0 +1,245 @@
+package mvcc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tidwall/btree"
+
+	"github.com/mukeshjc/mvcc-isolation/v2/utils"
+)
+
+// every set and delete leaves the old version behind in the chain, and every transaction stays in the history forever. Vacuum reclaims both.
+//
+// a version is dead once no running or future transaction can see it:
+//   - its creator rolled back. Nobody (but read uncommitted) ever sees it.
+//   - it was deleted by a transaction that committed before every running transaction began.
+//
+// the second rule needs the "snapshot horizon": the oldest snapshot (startTs) of any running transaction, or the last commit timestamp when nothing runs.
+// everything that committed at or before it looks the same to all running transactions, and any transaction starting later has an even newer snapshot.
+//
+// a transaction record can go once it rolled back or committed at or before the snapshot horizon, it began before every running transaction
+// (the Horizon reported), and no remaining version references it as txStartId or txEndId.
+// nothing running considers it concurrent anymore, so the commit-time conflict checks won't look it up either.
+
+// VacuumStats reports what a vacuum reclaimed.
+type VacuumStats struct {
+	// the oldest running transaction, only transactions with an id below it were considered for removal.
+	Horizon uint64
+
+	KeysScanned         int
+	VersionsRemoved     int
+	KeysRemoved         int
+	TransactionsRemoved int
+	Duration            time.Duration
+}
+
+func (s *VacuumStats) add(other VacuumStats) {
+	s.Horizon = other.Horizon
+	s.KeysScanned += other.KeysScanned
+	s.VersionsRemoved += other.VersionsRemoved
+	s.KeysRemoved += other.KeysRemoved
+	s.TransactionsRemoved += other.TransactionsRemoved
+	s.Duration += other.Duration
+}
+
+// Vacuum removes dead versions, keys left without any version, and transaction records nothing refers to anymore.
+// It is safe to run concurrently with transactions.
+func (d *Database) Vacuum() VacuumStats {
+	d.vacuumMu.Lock()
+	defer d.vacuumMu.Unlock()
+
+	start := time.Now()
+	var snapshotHorizon uint64
+	stats := VacuumStats{}
+	stats.Horizon, snapshotHorizon = d.horizon()
+
+	d.writesSinceVacuum.Store(0)
+
+	d.storeMu.RLock()
+	keys := d.store.Keys()
+	d.storeMu.RUnlock()
+
+	// transaction ids below the horizon still referenced by a version.
+	var referenced btree.Set[uint64]
+	for _, key := range keys {
+		chain := d.chain(key, false)
+		if chain == nil {
+			continue
+		}
+		stats.KeysScanned++
+
+		chain.mu.Lock()
+		removed := d.vacuumChain(chain, snapshotHorizon)
+		stats.VersionsRemoved += removed
+		for _, value := range chain.versions {
+			if value.txStartId < stats.Horizon {
+				referenced.Insert(value.txStartId)
+			}
+			for _, id := range append([]uint64{value.txEndId}, value.priorEnds...) {
+				if id > 0 && id < stats.Horizon {
+					referenced.Insert(id)
+				}
+			}
+		}
+
+		if len(chain.versions) == 0 {
+			// writers that already looked the chain up will notice it was removed and look it up again.
+			chain.removed = true
+			d.storeMu.Lock()
+			d.store.Delete(key)
+			d.storeMu.Unlock()
+			stats.KeysRemoved++
+		}
+		chain.mu.Unlock()
+	}
+
+	// nothing new can refer to a transaction below the horizon: only running transactions create or end versions.
+	d.txMu.Lock()
+	var ids []uint64
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok && iter.Key() < stats.Horizon; ok = iter.Next() {
+		t := iter.Value()
+		if (t.state == RolledBackTransaction || (t.state == CommittedTransaction && t.commitTs <= snapshotHorizon)) && !referenced.Contains(t.id) {
+			ids = append(ids, t.id)
+		}
+	}
+	for _, id := range ids {
+		d.transactions.Delete(id)
+	}
+	// commit-time checks only look at commits after the snapshot of the committing transaction.
+	for ts, _, ok := d.commits.Min(); ok && ts <= snapshotHorizon; ts, _, ok = d.commits.Min() {
+		d.commits.Delete(ts)
+	}
+	d.txMu.Unlock()
+	stats.TransactionsRemoved = len(ids)
+
+	d.ssi.prune(snapshotHorizon)
+
+	stats.Duration = time.Since(start)
+	utils.Debug("vacuum", stats)
+	return stats
+}
+
+// the oldest running transaction id (or the next id when nothing runs), and the oldest snapshot any running transaction reads.
+// the caller must vacuum with them: the snapshot horizon becomes the limit for time travel right away.
+func (d *Database) horizon() (uint64, uint64) {
+	d.txMu.RLock()
+	defer d.txMu.RUnlock()
+
+	horizon, snapshotHorizon := d.nextTransactionId, d.lastCommitTs
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		t := iter.Value()
+		if t.state != InProgressTransaction {
+			continue
+		}
+		horizon = min(horizon, t.id)
+		snapshotHorizon = min(snapshotHorizon, t.startTs)
+	}
+	// published while txMu is held, so a time-travel transaction either holds the horizon back or sees that it moved past it.
+	d.vacuumHorizon.Store(snapshotHorizon)
+	return horizon, snapshotHorizon
+}
+
+// removes the dead versions of a chain and returns how many. must be called with the chain locked.
+func (d *Database) vacuumChain(chain *versionChain, snapshotHorizon uint64) int {
+	live := chain.versions[:0]
+	for _, value := range chain.versions {
+		creator := d.transactionState(value.txStartId).state
+		if creator == RolledBackTransaction {
+			continue
+		}
+
+		if value.txEndId > 0 {
+			if value.endedBy(func(id uint64) bool {
+				ender := d.transactionState(id)
+				return ender.state == CommittedTransaction && ender.commitTs <= snapshotHorizon
+			}) {
+				continue
+			}
+			// a delete that rolled back never happened.
+			value.unmark(func(id uint64) bool { return d.transactionState(id).state == RolledBackTransaction })
+		}
+
+		live = append(live, value)
+	}
+
+	removed := len(chain.versions) - len(live)
+	clear(chain.versions[len(live):])
+	chain.versions = live
+	return removed
+}
+
+// AutoVacuumConfig tunes the background vacuum.
+type AutoVacuumConfig struct {
+	// how often to check whether a vacuum is due.
+	Interval time.Duration
+	// minimum number of sets and deletes since the last vacuum before another one runs. Zero vacuums on every interval.
+	Threshold int64
+	// called after every background vacuum, if set.
+	OnVacuum func(VacuumStats)
+}
+
+type AutoVacuum struct {
+	stop chan struct{}
+	done chan struct{}
+
+	mu     sync.Mutex
+	totals VacuumStats
+	runs   int
+}
+
+// StartAutoVacuum runs Vacuum in a background goroutine until Stop is called.
+func (d *Database) StartAutoVacuum(config AutoVacuumConfig) *AutoVacuum {
+	utils.Assert(config.Interval > 0, "auto vacuum interval must be positive")
+
+	a := &AutoVacuum{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(a.done)
+
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C:
+			}
+
+			if d.writesSinceVacuum.Load() < config.Threshold {
+				continue
+			}
+
+			stats := d.Vacuum()
+			a.mu.Lock()
+			a.totals.add(stats)
+			a.runs++
+			a.mu.Unlock()
+
+			if config.OnVacuum != nil {
+				config.OnVacuum(stats)
+			}
+		}
+	}()
+
+	return a
+}
+
+// Stop ends the background vacuum and waits for a running vacuum to finish.
+func (a *AutoVacuum) Stop() {
+	close(a.stop)
+	<-a.done
+}
+
+// Stats returns the totals over all background vacuums so far, and how many ran.
+func (a *AutoVacuum) Stats() (VacuumStats, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.totals, a.runs
+}
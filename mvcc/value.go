@@ -1,8 +1,59 @@
 package mvcc
 
+import (
+	"slices"
+	"sync"
+)
+
 // a value in the database will be defined with start and end transaction ids.
 type Value struct {
 	txStartId uint64
 	txEndId   uint64
 	value     string
+
+	// the transactions that ended the version before txEndId did, oldest first. Without blocking writes two transactions can end the same
+	// version, e.g. a repeatable read delete of a version whose ender committed after the snapshot, or two deletes of it at once. Each of
+	// them deletes the version once it commits, whatever the others do, so none of their marks may be lost to a later one.
+	priorEnds []uint64
+}
+
+// mark ends the version by txId.
+func (v *Value) mark(txId uint64) {
+	if v.txEndId > 0 && v.txEndId != txId {
+		v.priorEnds = append(v.priorEnds, v.txEndId)
+	}
+	v.txEndId = txId
+}
+
+// unmark takes off the mark of every transaction drop returns true for, the newest remaining one becomes txEndId.
+func (v *Value) unmark(drop func(txId uint64) bool) {
+	var enders []uint64
+	for _, id := range append(v.priorEnds, v.txEndId) {
+		if id > 0 && !drop(id) {
+			enders = append(enders, id)
+		}
+	}
+
+	v.txEndId, v.priorEnds = 0, nil
+	if n := len(enders); n > 0 {
+		v.txEndId, v.priorEnds = enders[n-1], enders[:n-1]
+	}
+}
+
+// whether the version was ended by a transaction f returns true for.
+func (v Value) endedBy(f func(txId uint64) bool) bool {
+	if v.txEndId > 0 && f(v.txEndId) {
+		return true
+	}
+	return slices.ContainsFunc(v.priorEnds, f)
+}
+
+// every key owns its own list of value versions guarded by its own lock, so that transactions touching different keys never wait on each other.
+// readers (get) take the read lock, writers (set/delete) take the write lock since they mark txEndId on existing versions and append new ones.
+type versionChain struct {
+	mu       sync.RWMutex
+	versions []Value
+
+	// set by vacuum when it drops an empty chain from the store.
+	removed bool
 }
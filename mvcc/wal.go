@@ -0,0 +1,390 @@
+package mvcc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/mukeshjc/mvcc-isolation/v2/utils"
+)
+
+// the write-ahead log is an append-only file of records, one per begin/set/delete/commit/rollback, and one per write undone by rolling back to a savepoint.
+// every record is written before its effect is applied in memory, so replaying the log in order rebuilds the version chains and the transaction states.
+// begin and commit records are appended in the same critical section that takes the snapshot or hands out the commit timestamp, so the order of the
+// records alone restores both: a transaction's snapshot is the number of commits before its begin record.
+//
+// on disk every record is framed as:
+//
+//	[payload length uint32][crc32 of payload uint32][payload]
+//
+// a crash can leave a partially written record at the end of the file. Recovery stops at the first record whose frame is incomplete
+// or whose checksum doesn't match, and truncates the file there so new records are appended after the last good one.
+
+// SyncPolicy decides when the log is fsync'ed to stable storage.
+type SyncPolicy uint8
+
+const (
+	// leave flushing to the operating system. A crash of the process loses nothing, a crash of the machine may lose recent commits.
+	SyncNever SyncPolicy = iota
+	// fsync when a transaction commits, so a commit that returned successfully survives a machine crash.
+	SyncOnCommit
+	// fsync after every record.
+	SyncAlways
+)
+
+type walRecordType uint8
+
+const (
+	walBegin walRecordType = iota + 1
+	walSet
+	walDelete
+	walCommit
+	walRollback
+	// a set or delete reverted by rolling back to a savepoint.
+	walUndo
+)
+
+const walHeaderSize = 8
+
+// a decoded log record. Which fields are meaningful depends on the type.
+type walRecord struct {
+	typ       walRecordType
+	txId      uint64
+	isolation IsolationLevel
+	key       string
+	value     string
+	// the txStartId of every version the set/delete marked with its txEndId.
+	// a transaction can see at most one version per creating transaction, the newest one, so this identifies the versions without depending on positions in the chain.
+	ends []uint64
+	// for undo: whether the undone write was a set, which appended a version.
+	appended bool
+}
+
+type wal struct {
+	mu     sync.Mutex
+	file   *os.File
+	policy SyncPolicy
+
+	// after a failed write the tail of the file is unknown, it may hold part of a record. Anything appended behind it would be lost at recovery,
+	// so the first error sticks and every later append fails with it.
+	err error
+}
+
+// all methods are no-ops on a nil *wal, which is what a database without a log has.
+func (w *wal) append(r walRecord) error {
+	if w == nil {
+		return nil
+	}
+
+	payload := r.encode()
+	frame := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	frame = append(frame, payload...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if _, err := w.file.Write(frame); err != nil {
+		w.err = fmt.Errorf("write-ahead log: %w", err)
+		return w.err
+	}
+	if w.policy == SyncAlways || (w.policy == SyncOnCommit && r.typ == walCommit) {
+		if err := w.file.Sync(); err != nil {
+			w.err = fmt.Errorf("write-ahead log: %w", err)
+			return w.err
+		}
+	}
+	return nil
+}
+
+func (w *wal) close() error {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// openWAL opens (or creates) the log at path and returns every intact record in it.
+// a torn or corrupt tail is cut off so that the file ends with the last intact record.
+func openWAL(path string, policy SyncPolicy) (*wal, []walRecord, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	var records []walRecord
+	offset := 0
+	for {
+		r, n, ok := decodeWALFrame(data[offset:])
+		if !ok {
+			break
+		}
+		records = append(records, r)
+		offset += n
+	}
+
+	if offset < len(data) {
+		utils.Debug("truncating write-ahead log", path, "from", len(data), "to", offset, "bytes")
+		if err := file.Truncate(int64(offset)); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
+	if _, err := file.Seek(int64(offset), io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return &wal{file: file, policy: policy}, records, nil
+}
+
+func decodeWALFrame(data []byte) (walRecord, int, bool) {
+	if len(data) < walHeaderSize {
+		return walRecord{}, 0, false
+	}
+
+	size := int(binary.LittleEndian.Uint32(data[0:4]))
+	checksum := binary.LittleEndian.Uint32(data[4:8])
+	if len(data)-walHeaderSize < size {
+		return walRecord{}, 0, false
+	}
+
+	payload := data[walHeaderSize : walHeaderSize+size]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return walRecord{}, 0, false
+	}
+
+	r, err := decodeWALRecord(payload)
+	if err != nil {
+		return walRecord{}, 0, false
+	}
+	return r, walHeaderSize + size, true
+}
+
+func (r walRecord) encode() []byte {
+	buf := []byte{byte(r.typ)}
+	buf = binary.AppendUvarint(buf, r.txId)
+
+	switch r.typ {
+	case walBegin:
+		buf = append(buf, byte(r.isolation))
+	case walSet, walDelete:
+		buf = appendString(buf, r.key)
+		if r.typ == walSet {
+			buf = appendString(buf, r.value)
+		}
+		buf = appendUvarints(buf, r.ends)
+	case walUndo:
+		buf = appendString(buf, r.key)
+		appended := byte(0)
+		if r.appended {
+			appended = 1
+		}
+		buf = append(buf, appended)
+		buf = appendUvarints(buf, r.ends)
+	}
+
+	return buf
+}
+
+func appendUvarints(buf []byte, ids []uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(ids)))
+	for _, id := range ids {
+		buf = binary.AppendUvarint(buf, id)
+	}
+	return buf
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+var errMalformedRecord = errors.New("malformed write-ahead log record")
+
+func decodeWALRecord(payload []byte) (walRecord, error) {
+	rd := bytes.NewReader(payload)
+
+	typ, err := rd.ReadByte()
+	if err != nil {
+		return walRecord{}, errMalformedRecord
+	}
+	r := walRecord{typ: walRecordType(typ)}
+
+	if r.txId, err = binary.ReadUvarint(rd); err != nil {
+		return walRecord{}, errMalformedRecord
+	}
+
+	switch r.typ {
+	case walBegin:
+		isolation, err := rd.ReadByte()
+		if err != nil {
+			return walRecord{}, errMalformedRecord
+		}
+		r.isolation = IsolationLevel(isolation)
+	case walSet, walDelete:
+		if r.key, err = readString(rd); err != nil {
+			return walRecord{}, err
+		}
+		if r.typ == walSet {
+			if r.value, err = readString(rd); err != nil {
+				return walRecord{}, err
+			}
+		}
+		if r.ends, err = readUvarints(rd); err != nil {
+			return walRecord{}, err
+		}
+	case walUndo:
+		if r.key, err = readString(rd); err != nil {
+			return walRecord{}, err
+		}
+		appended, err := rd.ReadByte()
+		if err != nil || appended > 1 {
+			return walRecord{}, errMalformedRecord
+		}
+		r.appended = appended == 1
+		if r.ends, err = readUvarints(rd); err != nil {
+			return walRecord{}, err
+		}
+	case walCommit, walRollback:
+	default:
+		return walRecord{}, errMalformedRecord
+	}
+
+	if rd.Len() != 0 {
+		return walRecord{}, errMalformedRecord
+	}
+	return r, nil
+}
+
+func readUvarints(rd *bytes.Reader) ([]uint64, error) {
+	n, err := binary.ReadUvarint(rd)
+	if err != nil || n > uint64(rd.Len()) {
+		return nil, errMalformedRecord
+	}
+	ids := make([]uint64, n)
+	for i := range ids {
+		if ids[i], err = binary.ReadUvarint(rd); err != nil {
+			return nil, errMalformedRecord
+		}
+	}
+	return ids, nil
+}
+
+func readString(rd *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(rd)
+	if err != nil || n > uint64(rd.Len()) {
+		return "", errMalformedRecord
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		return "", errMalformedRecord
+	}
+	return string(buf), nil
+}
+
+// replay rebuilds the version chains and transaction states from the log. It runs before the database is handed out, so no locks are needed.
+// transactions that have no commit or rollback record were in progress when the process stopped: they are rolled back, and the rollback is logged
+// so that the file itself reflects the outcome.
+func (d *Database) replay(records []walRecord) error {
+	for _, r := range records {
+		switch r.typ {
+		case walBegin:
+			d.transactions.Set(r.txId, Transaction{
+				id:        r.txId,
+				isolation: r.isolation,
+				state:     InProgressTransaction,
+				startTs:   d.lastCommitTs,
+			})
+			if r.txId >= d.nextTransactionId {
+				d.nextTransactionId = r.txId + 1
+			}
+
+		case walSet, walDelete:
+			chain := d.chain(r.key, true)
+			for _, creator := range r.ends {
+				if i := newestVersionBy(chain, creator); i > -1 {
+					chain.versions[i].mark(r.txId)
+				}
+			}
+			if r.typ == walSet {
+				chain.versions = append(chain.versions, Value{
+					txStartId: r.txId,
+					value:     r.value,
+				})
+			}
+
+		case walUndo:
+			chain := d.chain(r.key, false)
+			if chain == nil {
+				return fmt.Errorf("write-ahead log: undo of transaction %d on unknown key %q", r.txId, r.key)
+			}
+			undoWrite(chain, r.txId, r.appended, r.ends)
+
+		case walCommit, walRollback:
+			t, ok := d.transactions.Get(r.txId)
+			if !ok {
+				return fmt.Errorf("write-ahead log: %v for unknown transaction %d", r.typ, r.txId)
+			}
+			state := CommittedTransaction
+			if r.typ == walRollback {
+				state = RolledBackTransaction
+			}
+			d.finishTransaction(&t, state)
+		}
+	}
+
+	inprogress := d.inprogress()
+	for _, t := range inprogress.Keys() {
+		utils.Debug("rolling back transaction", t, "found in progress during recovery")
+		if err := d.wal.append(walRecord{typ: walRollback, txId: t}); err != nil {
+			return err
+		}
+		tx, _ := d.transactions.Get(t)
+		d.finishTransaction(&tx, RolledBackTransaction)
+	}
+
+	return nil
+}
+
+func (t walRecordType) String() string {
+	switch t {
+	case walBegin:
+		return "begin"
+	case walSet:
+		return "set"
+	case walDelete:
+		return "delete"
+	case walCommit:
+		return "commit"
+	case walRollback:
+		return "rollback"
+	case walUndo:
+		return "undo"
+	}
+	return fmt.Sprintf("walRecordType(%d)", uint8(t))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mukeshjc/mvcc-isolation/v2/mvcc"
+	"github.com/mukeshjc/mvcc-isolation/v2/utils"
+)
+
+func update(database *mvcc.Database, key string, value string) {
+	c := database.NewConnection()
+	c.MustExecCommand("begin", nil)
+	c.MustExecCommand("set", []string{key, value})
+	c.MustExecCommand("commit", nil)
+}
+
+func TestVacuum(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.RepeatableReadIsolation)
+
+	// transactions 1 to 5.
+	for i := 1; i <= 5; i++ {
+		update(database, "x", strconv.Itoa(i))
+	}
+
+	// a long running reader (transaction 6) pins the snapshot where x is 5.
+	reader := database.NewConnection()
+	reader.MustExecCommand("begin", nil)
+	utils.AssertEq(reader.MustExecCommand("get", []string{"x"}), "5", "reader get x")
+
+	// transactions 7 to 11.
+	for i := 6; i <= 10; i++ {
+		update(database, "x", strconv.Itoa(i))
+	}
+
+	// transaction 12 rolls back, its version is garbage right away.
+	c := database.NewConnection()
+	c.MustExecCommand("begin", nil)
+	c.MustExecCommand("set", []string{"x", "rolled back"})
+	c.MustExecCommand("set", []string{"y", "rolled back"})
+	c.MustExecCommand("rollback", nil)
+
+	stats := database.Vacuum()
+	utils.AssertEq(stats.Horizon, uint64(6), "horizon is the reader")
+	utils.AssertEq(stats.KeysScanned, 2, "keys scanned")
+	// versions 1 to 4 were overwritten before the reader began, plus the two rolled back versions.
+	utils.AssertEq(stats.VersionsRemoved, 6, "versions removed")
+	utils.AssertEq(stats.KeysRemoved, 1, "y has no versions left")
+	// transactions 1 to 4 created and ended only dead versions. 5 still created the version the reader sees.
+	utils.AssertEq(stats.TransactionsRemoved, 4, "transactions removed")
+
+	// the reader still sees its snapshot, new transactions the latest value.
+	utils.AssertEq(reader.MustExecCommand("get", []string{"x"}), "5", "reader get x")
+	c.MustExecCommand("begin", nil)
+	utils.AssertEq(c.MustExecCommand("get", []string{"x"}), "10", "c get x")
+	_, err := c.ExecCommand("get", []string{"y"})
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c get y")
+	c.MustExecCommand("commit", nil)
+
+	// once the reader is done, everything but the latest version goes.
+	reader.MustExecCommand("commit", nil)
+	stats = database.Vacuum()
+	utils.AssertEq(stats.Horizon, uint64(14), "horizon with nothing running")
+	utils.AssertEq(stats.VersionsRemoved, 5, "versions removed")
+	utils.AssertEq(stats.TransactionsRemoved, 8, "transactions removed")
+
+	// and a key whose only version was deleted disappears.
+	c.MustExecCommand("begin", nil)
+	c.MustExecCommand("delete", []string{"x"})
+	c.MustExecCommand("commit", nil)
+	stats = database.Vacuum()
+	utils.AssertEq(stats.VersionsRemoved, 1, "versions removed")
+	utils.AssertEq(stats.KeysRemoved, 1, "keys removed")
+
+	// a removed key can be written again.
+	update(database, "x", "back")
+	c.MustExecCommand("begin", nil)
+	utils.AssertEq(c.MustExecCommand("get", []string{"x"}), "back", "c get x")
+	c.MustExecCommand("commit", nil)
+}
+
+// the background vacuum runs next to concurrent writers without losing any committed update.
+func TestAutoVacuum(t *testing.T) {
+	t.Parallel()
+
+	database := mvcc.NewDatabase(mvcc.SnapshotIsolation)
+	autovacuum := database.StartAutoVacuum(mvcc.AutoVacuumConfig{
+		Interval:  time.Millisecond,
+		Threshold: 10,
+	})
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			key := "key-" + strconv.Itoa(w)
+			for i := 0; i < 200; i++ {
+				c := database.NewConnection()
+				c.MustExecCommand("begin", nil)
+				if i%2 == 0 {
+					c.MustExecCommand("set", []string{key, strconv.Itoa(i)})
+				} else {
+					c.MustExecCommand("delete", []string{key})
+				}
+				c.MustExecCommand("commit", nil)
+			}
+			update(database, key, "done")
+		}(w)
+	}
+	wg.Wait()
+
+	autovacuum.Stop()
+	totals, runs := autovacuum.Stats()
+	utils.Assert(runs > 0, "auto vacuum ran")
+	utils.Assert(totals.VersionsRemoved > 0, "auto vacuum removed versions")
+
+	c := database.NewConnection()
+	c.MustExecCommand("begin", nil)
+	for w := 0; w < 4; w++ {
+		utils.AssertEq(c.MustExecCommand("get", []string{"key-" + strconv.Itoa(w)}), "done", "get key")
+	}
+	c.MustExecCommand("commit", nil)
+
+	// with nothing running, a final vacuum leaves one version per key.
+	database.Vacuum()
+	stats := database.Vacuum()
+	utils.AssertEq(stats.VersionsRemoved, 0, "nothing left to remove")
+	utils.AssertEq(stats.KeysScanned, 4, "one key per writer")
+}
+
+// under read uncommitted a delete can mark a version that vacuum removes before the delete is undone: its creator rolled back. Rolling back
+// to a savepoint from before the delete then has nothing left to revert, and the log still replays.
+func TestVacuumBeforeRollbackToSavepoint(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "db.wal")
+	database, err := mvcc.OpenDatabase(mvcc.ReadUncommittedIsolation, mvcc.WithWAL(path, mvcc.SyncNever))
+	utils.AssertEq(err, nil, "open database")
+
+	c0 := database.NewConnection()
+	c0.MustExecCommand("begin", nil)
+	c0.MustExecCommand("set", []string{"x", "c0"})
+
+	c1 := database.NewConnection()
+	c1.MustExecCommand("begin", nil)
+	c1.MustExecCommand("savepoint", []string{"sp"})
+	c1.MustExecCommand("delete", []string{"x"})
+
+	c0.MustExecCommand("rollback", nil)
+	stats := database.Vacuum()
+	utils.AssertEq(stats.KeysRemoved, 1, "keys removed")
+
+	c1.MustExecCommand("rollback", []string{"to", "sp"})
+	_, err = c1.ExecCommand("get", []string{"x"})
+	utils.Assert(errors.Is(err, mvcc.ErrNotFound), "c1 get x")
+	c1.MustExecCommand("commit", nil)
+	utils.AssertEq(database.Close(), nil, "close")
+
+	database, err = mvcc.OpenDatabase(mvcc.ReadUncommittedIsolation, mvcc.WithWAL(path, mvcc.SyncNever))
+	utils.AssertEq(err, nil, "reopen database")
+	defer database.Close()
+	assertState(committedState(database), map[string]string{}, "recovered")
+}
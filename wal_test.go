@@ -0,0 +1,250 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mukeshjc/mvcc-isolation/v2/mvcc"
+	"github.com/mukeshjc/mvcc-isolation/v2/utils"
+)
+
+var walKeys = []string{"a", "b", "c", "d", "e"}
+
+// reads every key in walKeys through a fresh transaction, missing keys are left out.
+func committedState(database *mvcc.Database) map[string]string {
+	c := database.NewConnection()
+	c.MustExecCommand("begin", nil)
+	defer c.MustExecCommand("commit", nil)
+
+	state := map[string]string{}
+	for _, key := range walKeys {
+		if res, err := c.ExecCommand("get", []string{key}); err == nil {
+			state[key] = res
+		}
+	}
+	return state
+}
+
+func assertState(actual map[string]string, expected map[string]string, prefix string) {
+	utils.AssertEq(len(actual), len(expected), prefix+" number of keys")
+	for key, value := range expected {
+		utils.AssertEq(actual[key], value, prefix+" key "+key)
+	}
+}
+
+type walCheckpoint struct {
+	size  int64
+	state map[string]string
+}
+
+// runs a workload of interleaved, conflicting, rolled back and unfinished transactions and returns the committed state after every commit
+// together with the size of the log at that point.
+func walWorkload(path string) []walCheckpoint {
+	database := mvcc.NewDatabase(mvcc.SnapshotIsolation, mvcc.WithWAL(path, mvcc.SyncAlways))
+	defer database.Close()
+
+	checkpoints := []walCheckpoint{{size: 0, state: map[string]string{}}}
+	checkpoint := func(state map[string]string) {
+		info, err := os.Stat(path)
+		utils.AssertEq(err, nil, "stat log")
+		checkpoints = append(checkpoints, walCheckpoint{size: info.Size(), state: state})
+	}
+
+	c1 := database.NewConnection()
+	c1.MustExecCommand("begin", nil)
+	c1.MustExecCommand("set", []string{"a", "1"})
+	c1.MustExecCommand("set", []string{"b", "2"})
+	c1.MustExecCommand("set", []string{"a", "1"})
+	c1.MustExecCommand("commit", nil)
+	checkpoint(map[string]string{"a": "1", "b": "2"})
+
+	c2 := database.NewConnection()
+	c2.MustExecCommand("begin", nil)
+	c3 := database.NewConnection()
+	c3.MustExecCommand("begin", nil)
+	c2.MustExecCommand("set", []string{"a", "10"})
+	c3.MustExecCommand("set", []string{"c", "3"})
+	c2.MustExecCommand("delete", []string{"b"})
+	c3.MustExecCommand("commit", nil)
+	checkpoint(map[string]string{"a": "1", "b": "2", "c": "3"})
+	c2.MustExecCommand("commit", nil)
+	checkpoint(map[string]string{"a": "10", "c": "3"})
+
+	c4 := database.NewConnection()
+	c4.MustExecCommand("begin", nil)
+	c5 := database.NewConnection()
+	c5.MustExecCommand("begin", nil)
+	c4.MustExecCommand("set", []string{"a", "11"})
+	c5.MustExecCommand("set", []string{"a", "12"})
+	c5.MustExecCommand("set", []string{"b", "12"})
+	c4.MustExecCommand("commit", nil)
+	checkpoint(map[string]string{"a": "11", "c": "3"})
+	_, err := c5.ExecCommand("commit", nil)
+	utils.Assert(err != nil, "c5 conflicts with c4")
+
+	c6 := database.NewConnection()
+	c6.MustExecCommand("begin", nil)
+	c6.MustExecCommand("set", []string{"d", "4"})
+	c6.MustExecCommand("delete", []string{"c"})
+	c6.MustExecCommand("rollback", nil)
+
+	c7 := database.NewConnection()
+	c7.MustExecCommand("begin", nil)
+	c7.MustExecCommand("set", []string{"d", "5"})
+	c7.MustExecCommand("commit", nil)
+	checkpoint(map[string]string{"a": "11", "c": "3", "d": "5"})
+
+	// never finished, the "crash" happens with this transaction in progress.
+	c8 := database.NewConnection()
+	c8.MustExecCommand("begin", nil)
+	c8.MustExecCommand("set", []string{"e", "6"})
+	c8.MustExecCommand("delete", []string{"a"})
+
+	return checkpoints
+}
+
+// cut the log at every byte offset, as if the process died in the middle of writing it. Recovery must come back with exactly the transactions
+// whose commit record made it to disk.
+func TestWALCrashRecovery(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "full.wal")
+	checkpoints := walWorkload(path)
+
+	data, err := os.ReadFile(path)
+	utils.AssertEq(err, nil, "read log")
+
+	for offset := 0; offset <= len(data); offset++ {
+		crashed := filepath.Join(dir, "crashed.wal")
+		utils.AssertEq(os.WriteFile(crashed, data[:offset], 0o644), nil, "write crashed log")
+
+		expected := checkpoints[0]
+		for _, c := range checkpoints {
+			if c.size <= int64(offset) {
+				expected = c
+			}
+		}
+
+		database, err := mvcc.OpenDatabase(mvcc.SnapshotIsolation, mvcc.WithWAL(crashed, mvcc.SyncNever))
+		utils.AssertEq(err, nil, "open crashed log")
+		assertState(committedState(database), expected.state, "recovered")
+
+		// the recovered database keeps working, and what it writes survives the next restart.
+		c := database.NewConnection()
+		c.MustExecCommand("begin", nil)
+		c.MustExecCommand("set", []string{"e", "after"})
+		c.MustExecCommand("commit", nil)
+		utils.AssertEq(database.Close(), nil, "close")
+
+		database, err = mvcc.OpenDatabase(mvcc.SnapshotIsolation, mvcc.WithWAL(crashed, mvcc.SyncNever))
+		utils.AssertEq(err, nil, "reopen log")
+		reopened := maps.Clone(expected.state)
+		reopened["e"] = "after"
+		assertState(committedState(database), reopened, "reopened")
+		utils.AssertEq(database.Close(), nil, "close")
+	}
+}
+
+func TestWALRecoveryRollsBackInProgress(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "db.wal")
+	checkpoints := walWorkload(path)
+
+	database, err := mvcc.OpenDatabase(mvcc.SnapshotIsolation, mvcc.WithWAL(path, mvcc.SyncOnCommit))
+	utils.AssertEq(err, nil, "open log")
+	defer database.Close()
+
+	// the unfinished set of e and delete of a are gone.
+	assertState(committedState(database), checkpoints[len(checkpoints)-1].state, "recovered")
+
+	// transaction ids keep going where the log left off (8 transactions in the workload, 1 to read the state above).
+	c := database.NewConnection()
+	res := c.MustExecCommand("begin", nil)
+	utils.AssertEq(res, "10", "next transaction id")
+
+	// the rolled back transaction doesn't make a write to the same key conflict.
+	c.MustExecCommand("set", []string{"e", "7"})
+	c.MustExecCommand("commit", nil)
+}
+
+// a flipped bit in the middle of the log ends recovery at the damaged record, nothing after it is trusted.
+func TestWALCorruptRecord(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.wal")
+	checkpoints := walWorkload(path)
+
+	data, err := os.ReadFile(path)
+	utils.AssertEq(err, nil, "read log")
+
+	// damage the last byte of the first commit's record.
+	first := checkpoints[1]
+	data[first.size-1] ^= 0xff
+	utils.AssertEq(os.WriteFile(path, data, 0o644), nil, "write damaged log")
+
+	database, err := mvcc.OpenDatabase(mvcc.SnapshotIsolation, mvcc.WithWAL(path, mvcc.SyncNever))
+	utils.AssertEq(err, nil, "open damaged log")
+	defer database.Close()
+
+	assertState(committedState(database), map[string]string{}, "recovered")
+}
+
+// writes undone by rolling back to a savepoint stay undone after recovery, the ones before the savepoint are kept.
+func TestWALSavepoints(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "db.wal")
+	database := mvcc.NewDatabase(mvcc.SnapshotIsolation, mvcc.WithWAL(path, mvcc.SyncNever))
+
+	c := database.NewConnection()
+	c.MustExecCommand("begin", nil)
+	c.MustExecCommand("set", []string{"a", "1"})
+	c.MustExecCommand("set", []string{"b", "1"})
+	c.MustExecCommand("commit", nil)
+
+	c.MustExecCommand("begin", nil)
+	c.MustExecCommand("set", []string{"a", "2"})
+	c.MustExecCommand("savepoint", []string{"s"})
+	c.MustExecCommand("set", []string{"a", "3"})
+	c.MustExecCommand("delete", []string{"b"})
+	c.MustExecCommand("set", []string{"c", "3"})
+	c.MustExecCommand("rollback", []string{"to", "s"})
+	c.MustExecCommand("set", []string{"d", "4"})
+	c.MustExecCommand("commit", nil)
+
+	expected := map[string]string{"a": "2", "b": "1", "d": "4"}
+	assertState(committedState(database), expected, "before restart")
+	utils.AssertEq(database.Close(), nil, "close")
+
+	database, err := mvcc.OpenDatabase(mvcc.SnapshotIsolation, mvcc.WithWAL(path, mvcc.SyncNever))
+	utils.AssertEq(err, nil, "reopen log")
+	defer database.Close()
+	assertState(committedState(database), expected, "after restart")
+}
+
+// the snapshot of every transaction is in the log, time travel works across a restart.
+func TestWALTimeTravel(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "db.wal")
+	checkpoints := walWorkload(path)
+
+	database, err := mvcc.OpenDatabase(mvcc.SnapshotIsolation, mvcc.WithWAL(path, mvcc.SyncNever))
+	utils.AssertEq(err, nil, "open log")
+	defer database.Close()
+
+	// transaction 1 committed the first checkpoint, 3 (which began while 2 was running) the second.
+	tx, err := database.Begin(mvcc.TxOptions{AsOf: 3})
+	utils.AssertEq(err, nil, "begin as of 3")
+	defer tx.Commit()
+	for key, expected := range checkpoints[2].state {
+		value, err := tx.Get(key)
+		utils.AssertEq(err, nil, "get as of 3")
+		utils.AssertEq(value, expected, "get as of 3")
+	}
+}